@@ -0,0 +1,155 @@
+// Package alert evaluates proximity alert rules on new snapshots and delivers
+// the alerts to webhooks.
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/config"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/detection"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"gorm.io/gorm"
+)
+
+// EventProximity is the event name of a proximity alert payload.
+const EventProximity = "proximity_alert"
+
+var cfg config.AlertConfig
+
+// Init sets the webhook timeout, retry policy and worker count. It must be
+// called before Start and before snapshots are ingested.
+func Init(c config.AlertConfig) {
+	cfg = c
+	client.Timeout = c.WebhookTimeout
+}
+
+// Payload is the JSON body posted to webhooks.
+type Payload struct {
+	Event         string    `json:"event"`
+	RuleID        int       `json:"rule_id"`
+	DeviceID      int       `json:"device_id"`
+	SnapshotID    int       `json:"snapshot_id"`
+	Class         string    `json:"class"`
+	MaxDistanceCM float64   `json:"max_distance_cm"`
+	MinCount      int       `json:"min_count"`
+	Count         int       `json:"count"`
+	NearestCM     float64   `json:"nearest_distance_cm"`
+	CapturedAt    time.Time `json:"captured_at"`
+	FiredAt       time.Time `json:"fired_at"`
+}
+
+// Enqueue records, in the transaction that stores a snapshot, that the
+// device's alert rules must be evaluated against it. Devices without enabled
+// rules are skipped. Call Notify once the transaction commits.
+func Enqueue(tx *gorm.DB, snapshot models.Snapshot) error {
+	var rules int64
+	if err := tx.Model(&models.AlertRule{}).Where("device_id = ? AND enabled", snapshot.DeviceID).Count(&rules).Error; err != nil {
+		return fmt.Errorf("failed to load alert rules: %w", err)
+	}
+	if rules == 0 {
+		return nil
+	}
+	if err := tx.Create(&models.AlertEvaluation{SnapshotID: snapshot.ID, NextAttemptAt: time.Now()}).Error; err != nil {
+		return fmt.Errorf("failed to queue alert evaluation: %w", err)
+	}
+	return nil
+}
+
+// evaluate checks the device's enabled rules against a queued snapshot and
+// queues an alert delivery for every rule that matches and is not cooling
+// down. Cooldowns, deliveries and the removal of the evaluation commit
+// together, so a failed evaluation can simply run again.
+func evaluate(evaluation models.AlertEvaluation) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		var snapshot models.Snapshot
+		err := tx.First(&snapshot, evaluation.SnapshotID).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err == nil {
+			var rules []models.AlertRule
+			if err := tx.Where("device_id = ? AND enabled", snapshot.DeviceID).Find(&rules).Error; err != nil {
+				return fmt.Errorf("failed to load alert rules: %w", err)
+			}
+			for _, rule := range rules {
+				if err := evaluateRule(tx, rule, snapshot); err != nil {
+					return fmt.Errorf("rule %d: %w", rule.ID, err)
+				}
+			}
+		}
+		return tx.Delete(&evaluation).Error
+	})
+}
+
+func evaluateRule(tx *gorm.DB, rule models.AlertRule, snapshot models.Snapshot) error {
+	var match struct {
+		Count   int
+		Nearest float64
+	}
+	err := tx.Model(&models.DetectionObject{}).
+		Select("COUNT(*) AS count, COALESCE(MIN(min_distance), 0) AS nearest").
+		Where("snapshot_id = ? AND min_distance <= ? AND class_id IN ("+detection.ClassTreeSQL+")",
+			snapshot.ID, rule.MaxDistanceCM, rule.Class, detection.NormalizeAlias(rule.Class)).
+		Scan(&match).Error
+	if err != nil {
+		return fmt.Errorf("failed to count objects: %w", err)
+	}
+	if match.Count < rule.MinCount {
+		return nil
+	}
+
+	// Claiming the cooldown in one conditional update keeps concurrent
+	// evaluations from firing the rule twice
+	now := time.Now()
+	cooldown := time.Duration(rule.CooldownSeconds) * time.Second
+	result := tx.Model(&models.AlertRule{}).
+		Where("id = ? AND (last_fired_at IS NULL OR last_fired_at <= ?)", rule.ID, now.Add(-cooldown)).
+		Update("last_fired_at", now)
+	if result.Error != nil {
+		return fmt.Errorf("failed to claim cooldown: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(Payload{
+		Event:         EventProximity,
+		RuleID:        rule.ID,
+		DeviceID:      snapshot.DeviceID,
+		SnapshotID:    snapshot.ID,
+		Class:         rule.Class,
+		MaxDistanceCM: rule.MaxDistanceCM,
+		MinCount:      rule.MinCount,
+		Count:         match.Count,
+		NearestCM:     match.Nearest,
+		CapturedAt:    snapshot.CapturedAt,
+		FiredAt:       now,
+	})
+	if err != nil {
+		return err
+	}
+
+	var webhooks []models.AlertWebhook
+	if err := tx.Where("device_id = ? AND enabled", snapshot.DeviceID).Find(&webhooks).Error; err != nil {
+		return fmt.Errorf("failed to load webhooks: %w", err)
+	}
+	for _, webhook := range webhooks {
+		delivery := models.AlertDelivery{
+			DeviceID:      snapshot.DeviceID,
+			RuleID:        rule.ID,
+			WebhookID:     webhook.ID,
+			SnapshotID:    snapshot.ID,
+			Payload:       payload,
+			Status:        StatusPending,
+			NextAttemptAt: &now,
+		}
+		if err := tx.Create(&delivery).Error; err != nil {
+			return fmt.Errorf("failed to log delivery: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package alert
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"gorm.io/gorm"
+)
+
+// pollInterval is how often queued evaluations and pending deliveries are
+// looked for, which bounds how late a retry runs after its backoff.
+const pollInterval = 5 * time.Second
+
+// evaluationLease is how long a claimed evaluation is hidden from other
+// workers and instances before it is tried again.
+const evaluationLease = time.Minute
+
+var (
+	// slots bounds the evaluations and webhook requests in flight to
+	// DeliveryWorkers.
+	slots chan struct{}
+	// wake starts a dispatch without waiting for the next poll.
+	wake = make(chan struct{}, 1)
+)
+
+// Start evaluates queued snapshots and dispatches pending deliveries in the
+// background, beginning with those a previous run left behind. Both are
+// stored before they are worked on, so a restart resumes them rather than
+// losing them.
+func Start() {
+	slots = make(chan struct{}, cfg.DeliveryWorkers)
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			dispatchDue(&models.AlertEvaluation{}, evaluationLease, func(id int64) {
+				var evaluation models.AlertEvaluation
+				if err := db.DB.First(&evaluation, id).Error; err != nil {
+					log.Printf("alert evaluation %d: %v", id, err)
+					return
+				}
+				if err := evaluate(evaluation); err != nil {
+					log.Printf("alerts for snapshot %d: %v", evaluation.SnapshotID, err)
+					return
+				}
+				Notify()
+			})
+			dispatchDue(&models.AlertDelivery{}, cfg.WebhookTimeout+time.Minute, func(id int64) {
+				var delivery models.AlertDelivery
+				if err := db.DB.First(&delivery, id).Error; err != nil {
+					log.Printf("alert delivery %d: %v", id, err)
+					return
+				}
+				attempt(delivery)
+			})
+			select {
+			case <-ticker.C:
+			case <-wake:
+			}
+		}
+	}()
+}
+
+// Notify starts working on newly queued evaluations or deliveries without
+// waiting for the next poll.
+func Notify() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Requeue makes a logged delivery pending again with a fresh round of
+// attempts.
+func Requeue(id int64) error {
+	err := db.DB.Model(&models.AlertDelivery{}).Where("id = ?", id).
+		Updates(map[string]any{"status": StatusPending, "attempts": 0, "next_attempt_at": time.Now()}).Error
+	if err != nil {
+		return err
+	}
+	Notify()
+	return nil
+}
+
+// dispatchDue hands every due row of model (an AlertEvaluation or an
+// AlertDelivery) to a worker running work, waiting for a free one when all
+// are busy.
+func dispatchDue(model any, lease time.Duration, work func(id int64)) {
+	query := db.DB.Model(model)
+	if _, ok := model.(*models.AlertDelivery); ok {
+		query = query.Where("status = ?", StatusPending)
+	}
+
+	for {
+		var due []int64
+		err := query.Session(&gorm.Session{}).Where("next_attempt_at IS NULL OR next_attempt_at <= ?", time.Now()).
+			Order("id").Limit(cfg.DeliveryWorkers).Pluck("id", &due).Error
+		if err != nil {
+			log.Printf("alerts: failed to load due work: %v", err)
+			return
+		}
+
+		claimed := 0
+		for _, id := range due {
+			slots <- struct{}{}
+			if !claim(query, id, lease) {
+				<-slots
+				continue
+			}
+			claimed++
+			go func() {
+				defer func() { <-slots }()
+				work(id)
+			}()
+		}
+		if len(due) < cfg.DeliveryWorkers || claimed == 0 {
+			return
+		}
+	}
+}
+
+// claim takes a due row by moving its next attempt past the time the work
+// can take, so other workers and instances skip it. Work cut short by a
+// restart is retried once that lease ends.
+func claim(query *gorm.DB, id int64, lease time.Duration) bool {
+	now := time.Now()
+	result := query.Session(&gorm.Session{}).
+		Where("id = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)", id, now).
+		Update("next_attempt_at", now.Add(lease))
+	if result.Error != nil {
+		log.Printf("alerts: failed to claim %d: %v", id, result.Error)
+		return false
+	}
+	return result.RowsAffected == 1
+}
+
+// attempt posts a claimed delivery to its webhook once and records the
+// outcome. A failed attempt is retried after RetryBackoff, doubled for each
+// earlier attempt, until MaxAttempts. Deliveries to deleted or disabled
+// webhooks fail without a request.
+func attempt(delivery models.AlertDelivery) {
+	updates := map[string]any{"attempts": gorm.Expr("attempts + 1"), "response_status": nil, "error": nil, "next_attempt_at": nil}
+
+	var webhook models.AlertWebhook
+	err := db.DB.First(&webhook, delivery.WebhookID).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		err = errors.New("webhook was deleted")
+		delivery.Attempts = cfg.MaxAttempts
+	case err != nil:
+		log.Printf("alert delivery %d: failed to load webhook: %v", delivery.ID, err)
+		return
+	case !webhook.Enabled:
+		err = errors.New("webhook is disabled")
+		delivery.Attempts = cfg.MaxAttempts
+	default:
+		var status int
+		status, err = post(delivery, webhook)
+		if status != 0 {
+			updates["response_status"] = status
+		}
+	}
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		updates["status"] = StatusDelivered
+		updates["delivered_at"] = now
+	case delivery.Attempts+1 >= cfg.MaxAttempts:
+		updates["status"] = StatusFailed
+		updates["error"] = err.Error()
+	default:
+		updates["error"] = err.Error()
+		updates["next_attempt_at"] = now.Add(cfg.RetryBackoff << delivery.Attempts)
+	}
+	if dbErr := db.DB.Model(&models.AlertDelivery{}).Where("id = ?", delivery.ID).Updates(updates).Error; dbErr != nil {
+		log.Printf("alert delivery %d: failed to record attempt: %v", delivery.ID, dbErr)
+	}
+	if err != nil {
+		log.Printf("alert delivery %d: attempt %d: %v", delivery.ID, delivery.Attempts+1, err)
+	}
+}
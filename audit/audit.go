@@ -0,0 +1,154 @@
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Actions recorded in the audit log.
+const (
+	ActionSnapshotCreate      = "snapshot.create"
+	ActionSnapshotBatchCreate = "snapshot.batch_create"
+	ActionSign                = "snapshot.sign"
+	ActionBulkSign            = "snapshot.bulk_sign"
+	ActionDelete              = "object.delete"
+	ActionBulkDelete          = "object.bulk_delete"
+	ActionBucketCreate        = "bucket.create"
+	ActionDeviceTokenIssue    = "device.token.issue"
+	ActionDeviceAPIKeyCreate  = "device.api_key.create"
+	ActionDeviceAPIKeyRevoke  = "device.api_key.revoke"
+	ActionDeviceCertRegister  = "device.certificate.register"
+	ActionDeviceCertRevoke    = "device.certificate.revoke"
+	ActionDeviceSigningKeySet = "device.signing_key.set"
+	ActionDeviceSigningKeyDel = "device.signing_key.delete"
+	ActionUserRoleUpdate      = "user.role.update"
+	ActionLogin               = "auth.login"
+	ActionRefresh             = "auth.refresh"
+	ActionLogout              = "auth.logout"
+	ActionPasswordChange      = "auth.password.change"
+	ActionPasswordResetIssue  = "auth.password.reset_issue"
+	ActionPasswordReset       = "auth.password.reset"
+	ActionDevicePasswordSet   = "device.password.set"
+	ActionDeviceSync          = "device.sync"
+	ActionDeviceTimezoneSet   = "device.timezone.set"
+	ActionClassCreate         = "class.create"
+	ActionClassUpdate         = "class.update"
+	ActionClassDelete         = "class.delete"
+	ActionClassMerge          = "class.merge"
+	ActionClassAliasCreate    = "class.alias.create"
+	ActionClassAliasDelete    = "class.alias.delete"
+	ActionExportCreate        = "export.create"
+	ActionAlertRuleCreate     = "alert.rule.create"
+	ActionAlertRuleUpdate     = "alert.rule.update"
+	ActionAlertRuleDelete     = "alert.rule.delete"
+	ActionAlertWebhookCreate  = "alert.webhook.create"
+	ActionAlertWebhookDelete  = "alert.webhook.delete"
+	ActionAlertRedeliver      = "alert.redeliver"
+)
+
+// Results recorded in the audit log.
+const (
+	ResultSuccess = "success"
+	ResultDenied  = "denied"
+	ResultFailure = "failure"
+)
+
+// Actor types recorded in the audit log.
+const (
+	ActorUser      = "user"
+	ActorDevice    = "device"
+	ActorAnonymous = "anonymous"
+)
+
+const (
+	targetsContextKey = "audit_targets"
+	actorContextKey   = "audit_actor"
+)
+
+type actor struct {
+	kind string
+	id   int
+}
+
+// Log records an audit event for action once the rest of the chain has run.
+// The result is derived from the response status; handlers name what they
+// acted on with SetTargets.
+func Log(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		Record(c, action)
+	}
+}
+
+// SetTargets records the URIs or IDs the current request acts on.
+func SetTargets(c *gin.Context, targets ...string) {
+	c.Set(targetsContextKey, targets)
+}
+
+// SetActor overrides the actor for requests that authenticate inside the
+// handler, such as login.
+func SetActor(c *gin.Context, actorType string, id int) {
+	c.Set(actorContextKey, actor{kind: actorType, id: id})
+}
+
+// Record writes an audit event for the current request. Failures to write are
+// logged and do not affect the response.
+func Record(c *gin.Context, action string) {
+	actorType, actorID := currentActor(c)
+
+	targets, _ := c.Get(targetsContextKey)
+	if targets == nil {
+		targets = []string{}
+	}
+	targetsJSON, err := json.Marshal(targets)
+	if err != nil {
+		log.Printf("audit: failed to marshal targets for %s: %v", action, err)
+		targetsJSON = []byte("[]")
+	}
+
+	status := c.Writer.Status()
+	event := models.AuditEvent{
+		ActorType:  actorType,
+		ActorID:    actorID,
+		IP:         c.ClientIP(),
+		Action:     action,
+		Targets:    targetsJSON,
+		Result:     resultFor(status),
+		StatusCode: status,
+	}
+	if err := db.DB.Create(&event).Error; err != nil {
+		log.Printf("audit: failed to record %s: %v", action, err)
+	}
+}
+
+func currentActor(c *gin.Context) (string, *int) {
+	if v, exists := c.Get(actorContextKey); exists {
+		if a, ok := v.(actor); ok {
+			return a.kind, &a.id
+		}
+	}
+	if claims, ok := middleware.CurrentUser(c); ok {
+		return ActorUser, &claims.UserID
+	}
+	if device, ok := middleware.CurrentDevice(c); ok {
+		return ActorDevice, &device.ID
+	}
+	return ActorAnonymous, nil
+}
+
+func resultFor(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ResultDenied
+	case status >= http.StatusBadRequest:
+		return ResultFailure
+	default:
+		return ResultSuccess
+	}
+}
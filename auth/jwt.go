@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/config"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	jwtSecret      []byte
+	accessTokenTTL time.Duration
+)
+
+// Init sets the secret and lifetime used for portal access tokens.
+func Init(cfg config.AuthConfig) {
+	jwtSecret = []byte(cfg.JWTSecret)
+	accessTokenTTL = cfg.AccessTokenTTL
+}
+
+// Claims are the claims carried by a portal access token.
+type Claims struct {
+	UserID int    `json:"uid"`
+	Role   string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// IssueAccessToken signs a short-lived HS256 access token for the user.
+func IssueAccessToken(user models.User) (string, time.Time, error) {
+	if len(jwtSecret) == 0 {
+		return "", time.Time{}, errors.New("auth is not initialised")
+	}
+
+	expiresAt := time.Now().Add(accessTokenTTL)
+	claims := Claims{
+		UserID: user.ID,
+		Role:   user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(user.ID),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign access token: %w", err)
+	}
+	return signed, expiresAt, nil
+}
+
+// ParseAccessToken validates an access token and returns its claims.
+func ParseAccessToken(tokenString string) (*Claims, error) {
+	if len(jwtSecret) == 0 {
+		return nil, errors.New("auth is not initialised")
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (any, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2id parameters for new hashes. Stored hashes with other parameters are
+// still accepted and are rehashed on the next successful login.
+const (
+	argonTime    uint32 = 3
+	argonMemory  uint32 = 64 * 1024
+	argonThreads uint8  = 2
+	argonKeyLen  uint32 = 32
+	argonSaltLen        = 16
+)
+
+const minPasswordLength = 8
+
+// ValidatePassword checks a new password against the password policy.
+func ValidatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	return nil
+}
+
+// HashPassword returns an argon2id hash of password in PHC string format.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// VerifyPassword reports whether password matches stored, and whether stored
+// should be replaced with a fresh HashPassword result. Besides argon2id it
+// accepts bcrypt hashes and legacy plaintext values, both of which always
+// need rehashing.
+func VerifyPassword(stored, password string) (ok, needsRehash bool) {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return verifyArgon2id(stored, password)
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, true
+	case stored == "":
+		return false, false
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, true
+	}
+}
+
+func verifyArgon2id(stored, password string) (ok, needsRehash bool) {
+	memory, iterations, threads, salt, key, err := decodeArgon2id(stored)
+	if err != nil {
+		return false, false
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(candidate, key) != 1 {
+		return false, false
+	}
+
+	outdated := memory != argonMemory || iterations != argonTime || threads != argonThreads || uint32(len(key)) != argonKeyLen
+	return true, outdated
+}
+
+func decodeArgon2id(stored string) (memory, iterations uint32, threads uint8, salt, key []byte, err error) {
+	// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return 0, 0, 0, nil, nil, errors.New("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return 0, 0, 0, nil, nil, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return 0, 0, 0, nil, nil, errors.New("malformed argon2id parameters")
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return 0, 0, 0, nil, nil, errors.New("malformed argon2id salt")
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return 0, 0, 0, nil, nil, errors.New("malformed argon2id key")
+	}
+	return memory, iterations, threads, salt, key, nil
+}
@@ -0,0 +1,93 @@
+package auth
+
+import "strings"
+
+// Role is the value stored in User.Role.
+type Role string
+
+const (
+	// RoleAdmin may act on any device's data and manage users.
+	RoleAdmin Role = "admin"
+	// RoleOperator runs devices and buckets on behalf of customers, so
+	// like an admin it may act on any device's data.
+	RoleOperator Role = "operator"
+	// RoleCustomer owns devices and their snapshots.
+	RoleCustomer Role = "customer"
+	// RoleViewer can only look at snapshots.
+	RoleViewer Role = "viewer"
+)
+
+// Permission is an action guarded by RequirePermission.
+type Permission string
+
+const (
+	PermSnapshotRead   Permission = "snapshot:read"
+	PermSnapshotSign   Permission = "snapshot:sign"
+	PermSnapshotDelete Permission = "snapshot:delete"
+	PermBucketManage   Permission = "bucket:manage"
+	PermDeviceManage   Permission = "device:manage"
+	PermUserManage     Permission = "user:manage"
+	PermClassManage    Permission = "class:manage"
+	PermExportWrite    Permission = "export:write"
+)
+
+var rolePermissions = map[Role]map[Permission]bool{
+	RoleAdmin: {
+		PermSnapshotRead:   true,
+		PermSnapshotSign:   true,
+		PermSnapshotDelete: true,
+		PermBucketManage:   true,
+		PermDeviceManage:   true,
+		PermUserManage:     true,
+		PermClassManage:    true,
+		PermExportWrite:    true,
+	},
+	RoleOperator: {
+		PermSnapshotRead:   true,
+		PermSnapshotSign:   true,
+		PermSnapshotDelete: true,
+		PermBucketManage:   true,
+		PermDeviceManage:   true,
+		PermClassManage:    true,
+		PermExportWrite:    true,
+	},
+	RoleCustomer: {
+		PermSnapshotRead:   true,
+		PermSnapshotSign:   true,
+		PermSnapshotDelete: true,
+		PermExportWrite:    true,
+	},
+	RoleViewer: {
+		PermSnapshotRead: true,
+		// Viewing an image requires a signed URL
+		PermSnapshotSign: true,
+	},
+}
+
+// ParseRole normalises a stored role string. Unknown roles are returned as-is
+// and have no permissions.
+func ParseRole(role string) Role {
+	return Role(strings.ToLower(strings.TrimSpace(role)))
+}
+
+// ValidRole reports whether role is one of the defined roles.
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[ParseRole(role)]
+	return ok
+}
+
+// IsAdmin reports whether role is the admin role.
+func IsAdmin(role string) bool {
+	return ParseRole(role) == RoleAdmin
+}
+
+// ManagesAllDevices reports whether role acts on every device and its data
+// rather than only the user's own, as admins and operators do.
+func ManagesAllDevices(role string) bool {
+	return HasPermission(role, PermDeviceManage)
+}
+
+// HasPermission reports whether role grants perm.
+func HasPermission(role string, perm Permission) bool {
+	return rolePermissions[ParseRole(role)][perm]
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PayloadMessage builds the canonical message a device signs for an ingest
+// request: the hex SHA-256 of the image, the detection JSON exactly as posted,
+// the device ID, the unix timestamp and the nonce, joined by newlines.
+func PayloadMessage(imageSHA256, detection string, deviceID int, timestamp, nonce string) []byte {
+	return []byte(strings.Join([]string{
+		imageSHA256,
+		detection,
+		strconv.Itoa(deviceID),
+		timestamp,
+		nonce,
+	}, "\n"))
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key.
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("public key is not valid base64: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// VerifyPayload checks a base64 Ed25519 signature of message.
+func VerifyPayload(publicKey, signature string, message []byte) error {
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not valid base64: %w", err)
+	}
+	if !ed25519.Verify(key, message, sig) {
+		return errors.New("signature does not match payload")
+	}
+	return nil
+}
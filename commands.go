@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/config"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/detection"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/export"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/handlers"
+)
+
+const backfillBatchSize = 500
+
+// commands are one-off maintenance tasks run instead of the server, e.g.
+// `aisense_portal_snapshot backfill-detections -config .env.yaml`. args are
+// the command's own flags, given after "--".
+var commands = map[string]func(cfg *config.Config, args []string) error{
+	"backfill-detections": backfillDetections,
+	"backfill-distances":  backfillDistances,
+	"export":              exportData,
+}
+
+func runCommand(name string, cfg *config.Config, args []string) error {
+	command, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return command(cfg, args)
+}
+
+// backfillDetections populates detection_objects from Snapshot.Detection.
+func backfillDetections(cfg *config.Config, args []string) error {
+	stats, err := detection.Backfill(db.DB, backfillBatchSize)
+	log.Printf("backfill-detections: scanned %d, stored %d, invalid %d", stats.Scanned, stats.Stored, stats.Invalid)
+	return err
+}
+
+// backfillDistances recomputes Snapshot.DistanceCM with the configured metric.
+func backfillDistances(cfg *config.Config, args []string) error {
+	stats, err := detection.BackfillDistances(db.DB, backfillBatchSize, cfg.Distance.Metric, cfg.Distance.Classes)
+	log.Printf("backfill-distances: scanned %d, updated %d, invalid %d", stats.Scanned, stats.Stored, stats.Invalid)
+	return err
+}
+
+// exportData writes snapshots or detection objects of all devices to a file
+// or stdout, e.g. `aisense_portal_snapshot export -config .env.yaml --
+// -dataset objects -format csv -filter 'device_id=3&class=person' -out objects.csv`.
+func exportData(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	datasetName := fs.String("dataset", string(export.DatasetSnapshots), "snapshots or objects")
+	formatName := fs.String("format", string(export.FormatCSV), "csv, ndjson or parquet")
+	filter := fs.String("filter", "", "snapshot search filters as a query string")
+	out := fs.String("out", "", "output file (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	dataset, err := export.ParseDataset(*datasetName)
+	if err != nil {
+		return err
+	}
+	format, err := export.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	filters, err := url.ParseQuery(*filter)
+	if err != nil {
+		return fmt.Errorf("invalid -filter: %w", err)
+	}
+
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if *out != "" {
+		if file, err = os.Create(*out); err != nil {
+			return err
+		}
+		w = file
+	}
+
+	rows, err := handlers.Export(w, dataset, format, filters)
+	log.Printf("export: wrote %d %s rows", rows, dataset)
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
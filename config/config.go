@@ -0,0 +1,427 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/detection"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/ratelimit"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the service configuration, loaded once at startup by Load and
+// passed to the packages that need it.
+type Config struct {
+	Port      string
+	GinMode   string
+	ProjectID string
+	// TrustedProxies are the addresses or CIDRs whose X-Forwarded-For
+	// header is believed, and TrustedPlatform (appengine or cloudflare) a
+	// platform whose client IP header is; by default neither is, and the
+	// client IP is the connection's address.
+	TrustedProxies  []string
+	TrustedPlatform string
+
+	DB        DBConfig
+	GCS       GCSConfig
+	Auth      AuthConfig
+	TLS       TLSConfig
+	Signing   SigningConfig
+	RateLimit RateLimitConfig
+	Distance  DistanceConfig
+	Ingest    IngestConfig
+	Export    ExportConfig
+	Alert     AlertConfig
+}
+
+type DBConfig struct {
+	Host     string
+	User     string
+	Password string
+	Name     string
+	Port     int
+	SSLMode  string
+}
+
+type GCSConfig struct {
+	CredentialsFile string
+	BucketLocation  string
+}
+
+type AuthConfig struct {
+	JWTSecret      string
+	AccessTokenTTL time.Duration
+}
+
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// Enabled reports whether the service terminates TLS itself.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// MTLSEnabled reports whether device client certificates are verified.
+func (c TLSConfig) MTLSEnabled() bool {
+	return c.ClientCAFile != ""
+}
+
+type SigningConfig struct {
+	RequireSignedPayloads bool
+	MaxAge                time.Duration
+}
+
+type RateLimitConfig struct {
+	Store      string
+	Ingest     ratelimit.Limit
+	DeviceAuth ratelimit.Limit
+	Login      ratelimit.Limit
+	Sign       ratelimit.Limit
+	Delete     ratelimit.Limit
+}
+
+// DistanceConfig selects how Snapshot.DistanceCM is computed.
+type DistanceConfig struct {
+	Metric detection.Metric
+	// Classes limits the metric to these canonical class names; empty means
+	// every class.
+	Classes []string
+}
+
+type IngestConfig struct {
+	// MaxClockSkew is how far a device clock may be off before its
+	// snapshots are flagged.
+	MaxClockSkew time.Duration
+	// BatchConcurrency bounds how many items of one batch upload are
+	// processed at once, and so how many images are held in memory.
+	BatchConcurrency int
+	BatchMaxItems    int
+	// ThumbnailWorkers bounds how many thumbnails are generated at once;
+	// uploads beyond ThumbnailQueue waiting images get no thumbnails.
+	ThumbnailWorkers int
+	ThumbnailQueue   int
+}
+
+type ExportConfig struct {
+	// MaxStreamRows is the largest export streamed in the response; larger
+	// ones run as background jobs.
+	MaxStreamRows int
+	// Workers bounds how many background exports run at once; jobs beyond
+	// Queue waiting ones are refused.
+	Workers int
+	Queue   int
+}
+
+type AlertConfig struct {
+	WebhookTimeout time.Duration
+	// MaxAttempts bounds the deliveries of one alert to one webhook; the
+	// wait before a retry starts at RetryBackoff and doubles each time.
+	MaxAttempts  int
+	RetryBackoff time.Duration
+	// DeliveryWorkers bounds how many webhook requests are in flight.
+	DeliveryWorkers int
+}
+
+// setting is one configuration key. Every key can be set in the YAML file,
+// as an environment variable of the same name, or with a flag named after it
+// (DB_HOST becomes -db-host).
+type setting struct {
+	key   string
+	def   string
+	usage string
+}
+
+var settings = []setting{
+	{"PORT", "8080", "HTTP listen port"},
+	{"GIN_MODE", "", "gin mode: debug, release or test"},
+	{"TRUSTED_PROXIES", "", "comma-separated proxy addresses or CIDRs whose X-Forwarded-For is trusted"},
+	{"TRUSTED_PLATFORM", "", "platform whose client IP header is trusted: appengine or cloudflare"},
+	{"GCP_PROJECT_ID", "", "Google Cloud project that owns the buckets"},
+	{"DB_HOST", "", "Postgres host"},
+	{"DB_USER", "", "Postgres user"},
+	{"DB_PASSWORD", "", "Postgres password"},
+	{"DB_NAME", "", "Postgres database name"},
+	{"DB_PORT", "5432", "Postgres port"},
+	{"DB_SSLMODE", "disable", "Postgres sslmode"},
+	{"SERVICE_ACCOUNT_JSON_FILE_PATH", "", "GCS service account key file"},
+	{"BUCKET_LOCATION", "US", "location for new buckets"},
+	{"JWT_SECRET", "", "secret used to sign portal access tokens"},
+	{"ACCESS_TOKEN_TTL", "15m", "lifetime of portal access tokens"},
+	{"TLS_CERT_FILE", "", "serve TLS with this certificate"},
+	{"TLS_KEY_FILE", "", "private key for TLS_CERT_FILE"},
+	{"TLS_CLIENT_CA_FILE", "", "verify device client certificates against this CA (mTLS mode)"},
+	{"REQUIRE_SIGNED_PAYLOADS", "false", "reject ingest from devices without a signing key"},
+	{"SIGNATURE_MAX_AGE", "5m", "maximum age of a signed ingest payload"},
+	{"RATE_LIMIT_STORE", "memory", "rate limit store: memory or postgres"},
+	{"RATE_LIMIT_INGEST", "60/m", "ingest rate limit per device"},
+	{"RATE_LIMIT_DEVICE_AUTH", "120/m", "device authentication rate limit per IP"},
+	{"RATE_LIMIT_LOGIN", "10/m", "login and password rate limit per IP"},
+	{"RATE_LIMIT_SIGN", "300/m", "URL signing rate limit per user"},
+	{"RATE_LIMIT_DELETE", "60/m", "deletion rate limit per user"},
+	{"DISTANCE_METRIC", "nearest_min", "snapshot distance metric: nearest_min, nearest_mean or mean_min"},
+	{"MAX_CLOCK_SKEW", "2m", "flag snapshots from devices whose clock is off by more than this"},
+	{"BATCH_CONCURRENCY", "4", "items of a batch upload processed concurrently"},
+	{"BATCH_MAX_ITEMS", "100", "maximum items in one batch upload"},
+	{"THUMBNAIL_WORKERS", "2", "thumbnails generated concurrently"},
+	{"THUMBNAIL_QUEUE", "64", "images waiting for thumbnails before new ones are skipped"},
+	{"EXPORT_MAX_STREAM_ROWS", "100000", "largest export streamed directly; larger exports run as background jobs"},
+	{"EXPORT_WORKERS", "2", "background exports run concurrently"},
+	{"EXPORT_QUEUE", "16", "background exports waiting to run before new ones are refused"},
+	{"ALERT_WEBHOOK_TIMEOUT", "10s", "timeout of one alert webhook request"},
+	{"ALERT_MAX_ATTEMPTS", "5", "attempts to deliver an alert to a webhook"},
+	{"ALERT_RETRY_BACKOFF", "5s", "wait before the first alert webhook retry, doubled for each further retry"},
+	{"ALERT_DELIVERY_WORKERS", "4", "alert webhook requests made concurrently"},
+	{"DISTANCE_CLASSES", "", "comma-separated classes the distance metric considers (default all)"},
+}
+
+// Load builds the configuration from, in increasing priority: defaults, the
+// YAML file given by -config or CONFIG_FILE (same keys as .env.yaml), a .env
+// file if present, environment variables and command-line flags. All
+// validation errors are returned together.
+func Load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("aisense_portal_snapshot", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	flagValues := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagValues[s.key] = fs.String(flagName(s.key), "", s.usage+" ("+s.key+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(settings))
+	for _, s := range settings {
+		values[s.key] = s.def
+	}
+
+	if *configFile != "" {
+		fileValues, err := readYAML(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range fileValues {
+			values[key] = value
+		}
+	}
+
+	// A missing .env file is fine; it only fills variables that are not set
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load .env file: %w", err)
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.key); ok {
+			values[s.key] = v
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		for key, v := range flagValues {
+			if flagName(key) == f.Name {
+				values[key] = *v
+			}
+		}
+	})
+
+	return parse(values)
+}
+
+func parse(values map[string]string) (*Config, error) {
+	var errs []error
+	required := func(key string) string {
+		v := strings.TrimSpace(values[key])
+		if v == "" {
+			errs = append(errs, fmt.Errorf("%s is required", key))
+		}
+		return v
+	}
+	duration := func(key string) time.Duration {
+		d, err := time.ParseDuration(values[key])
+		if err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be a positive duration, got %q", key, values[key]))
+		}
+		return d
+	}
+	boolean := func(key string) bool {
+		b, err := strconv.ParseBool(values[key])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be true or false, got %q", key, values[key]))
+		}
+		return b
+	}
+	positive := func(key string) int {
+		n, err := strconv.Atoi(values[key])
+		if err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("%s must be a positive integer, got %q", key, values[key]))
+		}
+		return n
+	}
+	limit := func(key string) ratelimit.Limit {
+		l, err := ratelimit.ParseLimit(values[key])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+		return l
+	}
+
+	cfg := &Config{
+		Port:            required("PORT"),
+		GinMode:         values["GIN_MODE"],
+		ProjectID:       required("GCP_PROJECT_ID"),
+		TrustedPlatform: values["TRUSTED_PLATFORM"],
+		DB: DBConfig{
+			Host:     required("DB_HOST"),
+			User:     required("DB_USER"),
+			Password: values["DB_PASSWORD"],
+			Name:     required("DB_NAME"),
+			SSLMode:  required("DB_SSLMODE"),
+		},
+		GCS: GCSConfig{
+			CredentialsFile: required("SERVICE_ACCOUNT_JSON_FILE_PATH"),
+			BucketLocation:  required("BUCKET_LOCATION"),
+		},
+		Auth: AuthConfig{
+			JWTSecret:      required("JWT_SECRET"),
+			AccessTokenTTL: duration("ACCESS_TOKEN_TTL"),
+		},
+		TLS: TLSConfig{
+			CertFile:     values["TLS_CERT_FILE"],
+			KeyFile:      values["TLS_KEY_FILE"],
+			ClientCAFile: values["TLS_CLIENT_CA_FILE"],
+		},
+		Signing: SigningConfig{
+			RequireSignedPayloads: boolean("REQUIRE_SIGNED_PAYLOADS"),
+			MaxAge:                duration("SIGNATURE_MAX_AGE"),
+		},
+		Ingest: IngestConfig{
+			MaxClockSkew:     duration("MAX_CLOCK_SKEW"),
+			BatchConcurrency: positive("BATCH_CONCURRENCY"),
+			BatchMaxItems:    positive("BATCH_MAX_ITEMS"),
+			ThumbnailWorkers: positive("THUMBNAIL_WORKERS"),
+			ThumbnailQueue:   positive("THUMBNAIL_QUEUE"),
+		},
+		Export: ExportConfig{
+			MaxStreamRows: positive("EXPORT_MAX_STREAM_ROWS"),
+			Workers:       positive("EXPORT_WORKERS"),
+			Queue:         positive("EXPORT_QUEUE"),
+		},
+		Alert: AlertConfig{
+			WebhookTimeout:  duration("ALERT_WEBHOOK_TIMEOUT"),
+			MaxAttempts:     positive("ALERT_MAX_ATTEMPTS"),
+			RetryBackoff:    duration("ALERT_RETRY_BACKOFF"),
+			DeliveryWorkers: positive("ALERT_DELIVERY_WORKERS"),
+		},
+		RateLimit: RateLimitConfig{
+			Store:      values["RATE_LIMIT_STORE"],
+			Ingest:     limit("RATE_LIMIT_INGEST"),
+			DeviceAuth: limit("RATE_LIMIT_DEVICE_AUTH"),
+			Login:      limit("RATE_LIMIT_LOGIN"),
+			Sign:       limit("RATE_LIMIT_SIGN"),
+			Delete:     limit("RATE_LIMIT_DELETE"),
+		},
+	}
+
+	metric, err := detection.ParseMetric(values["DISTANCE_METRIC"])
+	if err != nil {
+		errs = append(errs, fmt.Errorf("DISTANCE_METRIC: %w", err))
+	}
+	cfg.Distance.Metric = metric
+	for _, class := range strings.Split(values["DISTANCE_CLASSES"], ",") {
+		if class = strings.TrimSpace(class); class != "" {
+			cfg.Distance.Classes = append(cfg.Distance.Classes, class)
+		}
+	}
+
+	for _, proxy := range strings.Split(values["TRUSTED_PROXIES"], ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			if _, err := netip.ParseAddr(proxy); err != nil {
+				errs = append(errs, fmt.Errorf("TRUSTED_PROXIES: %q is not an address or CIDR", proxy))
+				continue
+			}
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, proxy)
+	}
+	switch cfg.TrustedPlatform {
+	case "", "appengine", "cloudflare":
+	default:
+		errs = append(errs, fmt.Errorf("TRUSTED_PLATFORM must be appengine or cloudflare, got %q", cfg.TrustedPlatform))
+	}
+
+	port, err := strconv.Atoi(values["DB_PORT"])
+	if err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("DB_PORT must be a port number, got %q", values["DB_PORT"]))
+	}
+	cfg.DB.Port = port
+
+	switch cfg.GinMode {
+	case "", "debug", "release", "test":
+	default:
+		errs = append(errs, fmt.Errorf("GIN_MODE must be debug, release or test, got %q", cfg.GinMode))
+	}
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	if cfg.TLS.ClientCAFile != "" && cfg.TLS.CertFile == "" {
+		errs = append(errs, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE"))
+	}
+
+	switch cfg.RateLimit.Store {
+	case "memory", "postgres":
+	default:
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_STORE must be memory or postgres, got %q", cfg.RateLimit.Store))
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return cfg, nil
+}
+
+// readYAML reads a flat KEY: value file such as .env.yaml.
+func readYAML(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	known := make(map[string]bool, len(settings))
+	for _, s := range settings {
+		known[s.key] = true
+	}
+
+	values := make(map[string]string, len(raw))
+	var errs []error
+	for key, v := range raw {
+		if !known[key] {
+			errs = append(errs, fmt.Errorf("%s: unknown key %s", path, key))
+			continue
+		}
+		values[key] = fmt.Sprint(v)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return values, nil
+}
+
+func flagName(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
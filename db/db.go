@@ -3,29 +3,19 @@ package db
 import (
 	"fmt"
 	"log"
-	"os"
-	"strconv"
 
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/config"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 var DB *gorm.DB
 
-func Init() {
-	host := os.Getenv("DB_HOST")
-	user := os.Getenv("DB_USER")
-	password := os.Getenv("DB_PASSWORD")
-	db_name := os.Getenv("DB_NAME")
-	portStr := os.Getenv("DB_PORT")
-	port, er := strconv.Atoi(portStr)
-	if er != nil {
-		log.Fatalf("Invalid DB_PORT: %v", er)
-	}
-
+func Init(cfg config.DBConfig) {
 	dsn := fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s port=%d sslmode=%s",
-		host, user, password, db_name, port, "disable",
+		cfg.Host, cfg.User, cfg.Password, cfg.Name, cfg.Port, cfg.SSLMode,
 	)
 	var err error
 	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
@@ -39,3 +29,31 @@ func Init() {
 		log.Println("Connected to database")
 	}
 }
+
+// Migrate creates or updates the tables owned by this service.
+func Migrate() {
+	if err := DB.AutoMigrate(
+		&models.Snapshot{},
+		&models.Classes{},
+		&models.ClassAlias{},
+		&models.DetectionObject{},
+		&models.DeviceToken{},
+		&models.DeviceAPIKey{},
+		&models.DeviceCertificate{},
+		&models.DeviceSigningKey{},
+		&models.DeviceNonce{},
+		&models.DeviceSyncStatus{},
+		&models.DeviceTimezone{},
+		&models.ExportJob{},
+		&models.AlertRule{},
+		&models.AlertWebhook{},
+		&models.AlertEvaluation{},
+		&models.AlertDelivery{},
+		&models.AuditEvent{},
+		&models.RateLimitBucket{},
+		&models.RefreshToken{},
+		&models.PasswordResetToken{},
+	); err != nil {
+		log.Fatal("Failed to migrate database: ", err)
+	}
+}
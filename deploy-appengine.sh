@@ -0,0 +1,13 @@
+#!/bin/bash
+set -euo pipefail
+
+# app.yaml includes the git-ignored app.secrets.yaml for JWT_SECRET. Write it
+# from Secret Manager (see deploy.sh for creating the secret) just for the
+# deploy, readable only by the current user, and remove it afterwards.
+umask 077
+trap 'rm -f app.secrets.yaml' EXIT
+secret=$(gcloud secrets versions access latest --secret=aisense-jwt-secret)
+printf "env_variables:\n  JWT_SECRET: '%s'\n" "${secret//\'/\'\'}" > app.secrets.yaml
+unset secret
+
+gcloud app deploy app.yaml
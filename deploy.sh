@@ -6,6 +6,12 @@ docker build -t us-central1-docker.pkg.dev/aicoexist-446217/aisense-repo/aisense
 # Push Docker image
 docker push us-central1-docker.pkg.dev/aicoexist-446217/aisense-repo/aisense_portal_snapshot
 
+# JWT_SECRET is required and comes from Secret Manager rather than .env.yaml.
+# Create it once, and let the Cloud Run service account read it:
+#   openssl rand -base64 48 | tr -d '\n' | gcloud secrets create aisense-jwt-secret --data-file=-
+#   gcloud secrets add-iam-policy-binding aisense-jwt-secret \
+#     --member=serviceAccount:<run service account> --role=roles/secretmanager.secretAccessor
+
 # Deploy to Cloud Run
 gcloud run deploy aisense-app \
   --image=us-central1-docker.pkg.dev/aicoexist-446217/aisense-repo/aisense_portal_snapshot \
@@ -14,6 +20,7 @@ gcloud run deploy aisense-app \
   --vpc-connector=aisense-vpc-connector \
   --vpc-egress=all-traffic \
   --env-vars-file .env.yaml \
+  --set-secrets=JWT_SECRET=aisense-jwt-secret:latest \
   --port=8080 \
   --allow-unauthenticated \
   --timeout=500s
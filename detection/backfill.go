@@ -0,0 +1,109 @@
+package detection
+
+import (
+	"log"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// BackfillStats summarises a Backfill run.
+type BackfillStats struct {
+	Scanned int
+	Stored  int
+	Invalid int
+}
+
+// Backfill writes DetectionObject rows for snapshots stored before the
+// table existed. Snapshots that already have rows are skipped, so it can be
+// rerun safely; snapshots whose Detection does not parse are logged and
+// counted as invalid.
+func Backfill(db *gorm.DB, batchSize int) (BackfillStats, error) {
+	var stats BackfillStats
+	lastID := 0
+	for {
+		var snapshots []models.Snapshot
+		err := db.Select("id", "detection").
+			Where("id > ?", lastID).
+			Where("NOT EXISTS (SELECT 1 FROM detection_objects d WHERE d.snapshot_id = snapshots.id)").
+			Order("id").
+			Limit(batchSize).
+			Find(&snapshots).Error
+		if err != nil {
+			return stats, err
+		}
+		if len(snapshots) == 0 {
+			return stats, nil
+		}
+
+		for _, snapshot := range snapshots {
+			lastID = snapshot.ID
+			stats.Scanned++
+
+			det, err := Parse(snapshot.Detection)
+			if err != nil {
+				log.Printf("backfill: snapshot %d: %v", snapshot.ID, err)
+				stats.Invalid++
+				continue
+			}
+			classIDs, err := ResolveClasses(db, det)
+			if err != nil {
+				return stats, err
+			}
+			if err := db.Transaction(func(tx *gorm.DB) error {
+				return Store(tx, snapshot.ID, det, classIDs)
+			}); err != nil {
+				return stats, err
+			}
+			stats.Stored++
+		}
+	}
+}
+
+// BackfillDistances recomputes Snapshot.DistanceCM for every snapshot with
+// the given metric, e.g. after the metric is changed. Snapshots without an
+// object the metric considers get NULL.
+func BackfillDistances(db *gorm.DB, batchSize int, metric Metric, classes []string) (BackfillStats, error) {
+	var stats BackfillStats
+	lastID := 0
+	for {
+		var snapshots []models.Snapshot
+		err := db.Select("id", "detection").
+			Where("id > ?", lastID).
+			Order("id").
+			Limit(batchSize).
+			Find(&snapshots).Error
+		if err != nil {
+			return stats, err
+		}
+		if len(snapshots) == 0 {
+			return stats, nil
+		}
+
+		for _, snapshot := range snapshots {
+			lastID = snapshot.ID
+			stats.Scanned++
+
+			det, err := Parse(snapshot.Detection)
+			if err != nil {
+				log.Printf("backfill: snapshot %d: %v", snapshot.ID, err)
+				stats.Invalid++
+				continue
+			}
+			// Class names in old rows may be aliases
+			if err := CanonicalClassNames(db, det); err != nil {
+				return stats, err
+			}
+
+			var distance any
+			if d, ok := det.Distance(metric, classes); ok {
+				distance = decimal.NewFromFloat(d)
+			}
+			if err := db.Model(&models.Snapshot{}).Where("id = ?", snapshot.ID).Update("distance_cm", distance).Error; err != nil {
+				return stats, err
+			}
+			stats.Stored++
+		}
+	}
+}
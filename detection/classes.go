@@ -0,0 +1,151 @@
+package detection
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ClassTreeSQL selects the id of the class named by the first two parameters
+// (class name, matched case-insensitively, then alias) and of all of its
+// descendants, so a filter on a parent class also matches its children.
+const ClassTreeSQL = `WITH RECURSIVE class_tree AS (
+		SELECT id FROM classes WHERE lower(name) = lower(?)
+		UNION SELECT class_id FROM class_aliases WHERE alias = ?
+		UNION SELECT c.id FROM classes c JOIN class_tree t ON c.parent_id = t.id
+	) SELECT id FROM class_tree`
+
+// NormalizeAlias returns the form aliases are stored and matched in.
+func NormalizeAlias(alias string) string {
+	return strings.ToLower(strings.TrimSpace(alias))
+}
+
+// classCacheTTL bounds how long another instance's class or alias edits can
+// go unnoticed; edits made through this instance invalidate the cache.
+const classCacheTTL = 5 * time.Minute
+
+type cachedClass struct {
+	class   models.Classes
+	expires time.Time
+}
+
+// classCache maps a class name as sent by devices to its canonical class.
+var classCache = struct {
+	sync.RWMutex
+	entries map[string]cachedClass
+}{entries: make(map[string]cachedClass)}
+
+// InvalidateClassCache drops all cached class resolutions. Call it after
+// changing classes or aliases.
+func InvalidateClassCache() {
+	classCache.Lock()
+	classCache.entries = make(map[string]cachedClass)
+	classCache.Unlock()
+}
+
+// ResolveClasses maps every class name in det to its canonical class,
+// creating classes that are neither known nor aliased. det.Objects is
+// rewritten to use the canonical names, and their ids are returned by name.
+// New classes are committed immediately, so pass db.DB rather than the
+// snapshot's transaction; a rolled back snapshot then leaves only a class
+// row behind, never a cached id that does not exist.
+func ResolveClasses(db *gorm.DB, det *Detection) (map[string]int, error) {
+	objects := make(map[string][]Object, len(det.Objects))
+	classIDs := make(map[string]int, len(det.Objects))
+	for _, name := range sortedKeys(det.Objects) {
+		class, err := resolveClass(db, name, true)
+		if err != nil {
+			return nil, err
+		}
+		objects[class.Name] = append(objects[class.Name], det.Objects[name]...)
+		classIDs[class.Name] = class.ID
+	}
+	det.Objects = objects
+	return classIDs, nil
+}
+
+// CanonicalClassNames rewrites det.Objects to use canonical class names like
+// ResolveClasses, but only looks classes up: names that are neither known
+// nor aliased are kept as they are and no class is created.
+func CanonicalClassNames(db *gorm.DB, det *Detection) error {
+	objects := make(map[string][]Object, len(det.Objects))
+	for _, name := range sortedKeys(det.Objects) {
+		canonical := name
+		class, err := resolveClass(db, name, false)
+		if err == nil {
+			canonical = class.Name
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		objects[canonical] = append(objects[canonical], det.Objects[name]...)
+	}
+	det.Objects = objects
+	return nil
+}
+
+// resolveClass looks name up in the cache, then as an alias, then finds the
+// class by name, creating it if create is set. Without create an unknown
+// name gives gorm.ErrRecordNotFound.
+func resolveClass(db *gorm.DB, name string, create bool) (models.Classes, error) {
+	classCache.RLock()
+	cached, ok := classCache.entries[name]
+	classCache.RUnlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.class, nil
+	}
+
+	class, err := lookupClass(db, name, create)
+	if err != nil {
+		return class, err
+	}
+
+	classCache.Lock()
+	classCache.entries[name] = cachedClass{class: models.Classes{ID: class.ID, Name: class.Name}, expires: time.Now().Add(classCacheTTL)}
+	classCache.Unlock()
+	return class, nil
+}
+
+func lookupClass(db *gorm.DB, name string, create bool) (models.Classes, error) {
+	var class models.Classes
+	err := db.Joins("JOIN class_aliases ON class_aliases.class_id = classes.id").
+		Where("class_aliases.alias = ?", NormalizeAlias(name)).
+		First(&class).Error
+	if err == nil {
+		return class, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return class, fmt.Errorf("failed to load class alias: %w", err)
+	}
+
+	// Names differing only in case are the same class, as aliases are
+	err = db.Where("lower(name) = lower(?)", name).Order("id").First(&class).Error
+	if err == nil {
+		return class, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return class, fmt.Errorf("failed to load class: %w", err)
+	}
+	if !create {
+		return class, err
+	}
+
+	// A single upsert on the case-insensitive name index, so concurrent
+	// ingests of a new class, in any case, cannot race between looking it
+	// up and inserting it. The no-op update keeps the existing spelling and
+	// makes RETURNING yield an existing row too.
+	class = models.Classes{Name: name}
+	err = db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "lower(name)", Raw: true}},
+		DoUpdates: clause.Assignments(map[string]any{"name": gorm.Expr("classes.name")}),
+	}, clause.Returning{}).Create(&class).Error
+	if err != nil {
+		return class, fmt.Errorf("failed to create class: %w", err)
+	}
+	return class, nil
+}
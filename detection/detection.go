@@ -0,0 +1,294 @@
+package detection
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CurrentVersion is the schema version written for every stored detection.
+const CurrentVersion = 1
+
+const maxClassNameLength = 100
+
+// Detection is what a device reports for one frame: the detected objects
+// grouped by class name.
+type Detection struct {
+	Version int                 `json:"version"`
+	Objects map[string][]Object `json:"objects"`
+}
+
+// Object is one detected object.
+type Object struct {
+	Box        Box             `json:"box"`
+	Distance   CornerDistances `json:"distance"`
+	Confidence *float64        `json:"confidence,omitempty"`
+}
+
+// Box is the bounding box in image pixels. H may be 0 for legacy payloads
+// that only sent x, y and w.
+type Box struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	W float64 `json:"w"`
+	H float64 `json:"h"`
+}
+
+// CornerDistances are the measured distances to the box corners, in cm.
+type CornerDistances struct {
+	TopLeft     float64 `json:"top_left"`
+	TopRight    float64 `json:"top_right"`
+	BottomLeft  float64 `json:"bottom_left"`
+	BottomRight float64 `json:"bottom_right"`
+}
+
+// Min returns the smallest corner distance.
+func (d CornerDistances) Min() float64 {
+	return min(d.TopLeft, d.TopRight, d.BottomLeft, d.BottomRight)
+}
+
+// FieldError is a validation failure for one field of a detection payload.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem found in a detection payload.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "invalid detection: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Parse decodes and validates a detection payload. Besides the current
+// {"version": 1, "objects": {...}} shape it accepts the legacy
+// {"objects": {...}} wrapper, a bare class map as in note.json, and the
+// legacy "cordinate" spelling for "box". Any validation failure is returned
+// as a *ValidationError.
+func Parse(raw []byte) (*Detection, error) {
+	verr := &ValidationError{}
+
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &top); err != nil {
+		verr.add("detection", "must be a JSON object")
+		return nil, verr
+	}
+
+	version := CurrentVersion
+	classes := top
+	if v, ok := top["version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil || version != CurrentVersion {
+			verr.add("version", "unsupported version, expected %d", CurrentVersion)
+			return nil, verr
+		}
+	}
+	if objects, ok := top["objects"]; ok {
+		for key := range top {
+			if key != "objects" && key != "version" {
+				verr.add(key, "unknown field")
+			}
+		}
+		classes = nil
+		if err := json.Unmarshal(objects, &classes); err != nil || classes == nil {
+			verr.add("objects", "must be an object keyed by class name")
+			return nil, verr
+		}
+	} else if _, ok := top["version"]; ok {
+		verr.add("objects", "is required")
+		return nil, verr
+	}
+
+	det := &Detection{Version: version, Objects: make(map[string][]Object, len(classes))}
+	for _, className := range sortedKeys(classes) {
+		field := "objects." + className
+		if !ValidClassName(className) {
+			verr.add(field, "class name must be 1 to %d characters", maxClassNameLength)
+			continue
+		}
+
+		var items []json.RawMessage
+		if err := json.Unmarshal(classes[className], &items); err != nil {
+			verr.add(field, "must be an array of objects")
+			continue
+		}
+
+		objects := make([]Object, 0, len(items))
+		for i, item := range items {
+			if obj, ok := parseObject(item, fmt.Sprintf("%s[%d]", field, i), verr); ok {
+				objects = append(objects, obj)
+			}
+		}
+		det.Objects[className] = objects
+	}
+
+	if len(verr.Fields) > 0 {
+		return nil, verr
+	}
+	return det, nil
+}
+
+// ValidClassName reports whether name is acceptable as a class name.
+func ValidClassName(name string) bool {
+	return strings.TrimSpace(name) != "" && len(name) <= maxClassNameLength
+}
+
+func parseObject(raw json.RawMessage, field string, verr *ValidationError) (Object, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		verr.add(field, "must be an object")
+		return Object{}, false
+	}
+
+	before := len(verr.Fields)
+	var obj Object
+
+	boxRaw, hasBox := fields["box"]
+	legacyRaw, hasLegacy := fields["cordinate"]
+	switch {
+	case hasBox && hasLegacy:
+		verr.add(field+".box", "must not be sent together with cordinate")
+	case hasBox:
+		obj.Box = parseBox(boxRaw, field+".box", true, verr)
+	case hasLegacy:
+		obj.Box = parseBox(legacyRaw, field+".cordinate", false, verr)
+	default:
+		verr.add(field+".box", "is required")
+	}
+
+	if distRaw, ok := fields["distance"]; ok {
+		obj.Distance = parseDistances(distRaw, field+".distance", verr)
+	} else {
+		verr.add(field+".distance", "is required")
+	}
+
+	if confRaw, ok := fields["confidence"]; ok && string(confRaw) != "null" {
+		var confidence float64
+		if err := json.Unmarshal(confRaw, &confidence); err != nil || confidence < 0 || confidence > 1 {
+			verr.add(field+".confidence", "must be a number between 0 and 1")
+		} else {
+			obj.Confidence = &confidence
+		}
+	}
+
+	for _, key := range sortedKeys(fields) {
+		switch key {
+		case "box", "cordinate", "distance", "confidence":
+		default:
+			verr.add(field+"."+key, "unknown field")
+		}
+	}
+
+	return obj, len(verr.Fields) == before
+}
+
+func parseBox(raw json.RawMessage, field string, requireHeight bool, verr *ValidationError) Box {
+	values, ok := numberFields(raw, field, []string{"x", "y", "w", "h"}, verr)
+	if !ok {
+		return Box{}
+	}
+
+	var box Box
+	if x, ok := values["x"]; !ok {
+		verr.add(field+".x", "is required")
+	} else if x < 0 {
+		verr.add(field+".x", "must not be negative")
+	} else {
+		box.X = x
+	}
+	if y, ok := values["y"]; !ok {
+		verr.add(field+".y", "is required")
+	} else if y < 0 {
+		verr.add(field+".y", "must not be negative")
+	} else {
+		box.Y = y
+	}
+	if w, ok := values["w"]; !ok {
+		verr.add(field+".w", "is required")
+	} else if w <= 0 {
+		verr.add(field+".w", "must be greater than 0")
+	} else {
+		box.W = w
+	}
+	if h, ok := values["h"]; !ok {
+		if requireHeight {
+			verr.add(field+".h", "is required")
+		}
+	} else if h <= 0 {
+		verr.add(field+".h", "must be greater than 0")
+	} else {
+		box.H = h
+	}
+	return box
+}
+
+func parseDistances(raw json.RawMessage, field string, verr *ValidationError) CornerDistances {
+	corners := []string{"top_left", "top_right", "bottom_left", "bottom_right"}
+	values, ok := numberFields(raw, field, corners, verr)
+	if !ok {
+		return CornerDistances{}
+	}
+
+	for _, corner := range corners {
+		if v, ok := values[corner]; !ok {
+			verr.add(field+"."+corner, "is required")
+		} else if v < 0 {
+			verr.add(field+"."+corner, "must not be negative")
+		}
+	}
+	return CornerDistances{
+		TopLeft:     values["top_left"],
+		TopRight:    values["top_right"],
+		BottomLeft:  values["bottom_left"],
+		BottomRight: values["bottom_right"],
+	}
+}
+
+// numberFields decodes a flat object of numbers, reporting unknown keys and
+// non-numeric values.
+func numberFields(raw json.RawMessage, field string, allowed []string, verr *ValidationError) (map[string]float64, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		verr.add(field, "must be an object")
+		return nil, false
+	}
+
+	values := make(map[string]float64, len(fields))
+	for _, key := range sortedKeys(fields) {
+		known := false
+		for _, a := range allowed {
+			known = known || a == key
+		}
+		if !known {
+			verr.add(field+"."+key, "unknown field")
+			continue
+		}
+
+		var v float64
+		if err := json.Unmarshal(fields[key], &v); err != nil {
+			verr.add(field+"."+key, "must be a number")
+			continue
+		}
+		values[key] = v
+	}
+	return values, true
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,62 @@
+package detection
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Metric selects how a snapshot's distance is derived from the corner
+// distances of its objects.
+type Metric string
+
+const (
+	// MetricNearestMin is the smallest corner distance of any object.
+	MetricNearestMin Metric = "nearest_min"
+	// MetricNearestMean is the smallest mean corner distance of any object.
+	MetricNearestMean Metric = "nearest_mean"
+	// MetricMeanMin is the mean over objects of their smallest corner distance.
+	MetricMeanMin Metric = "mean_min"
+)
+
+// ParseMetric validates a metric name.
+func ParseMetric(s string) (Metric, error) {
+	switch m := Metric(s); m {
+	case MetricNearestMin, MetricNearestMean, MetricMeanMin:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown distance metric %q, expected %s, %s or %s", s, MetricNearestMin, MetricNearestMean, MetricMeanMin)
+}
+
+// Distance computes metric over the objects of the given classes, matched
+// case-insensitively, or of all classes if none are given. It reports false if there is no such object.
+func (d *Detection) Distance(metric Metric, classes []string) (float64, bool) {
+	var values []float64
+	for className, objects := range d.Objects {
+		if len(classes) > 0 && !slices.ContainsFunc(classes, func(class string) bool {
+			return strings.EqualFold(class, className)
+		}) {
+			continue
+		}
+		for _, obj := range objects {
+			if metric == MetricNearestMean {
+				c := obj.Distance
+				values = append(values, (c.TopLeft+c.TopRight+c.BottomLeft+c.BottomRight)/4)
+			} else {
+				values = append(values, obj.Distance.Min())
+			}
+		}
+	}
+	if len(values) == 0 {
+		return 0, false
+	}
+
+	if metric == MetricMeanMin {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values)), true
+	}
+	return slices.Min(values), true
+}
@@ -0,0 +1,45 @@
+package detection
+
+import (
+	"fmt"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"gorm.io/gorm"
+)
+
+// Store writes one DetectionObject row per detected object of the snapshot,
+// using the class ids returned by ResolveClasses. Run it in the snapshot's
+// transaction.
+func Store(tx *gorm.DB, snapshotID int, det *Detection, classIDs map[string]int) error {
+	var rows []models.DetectionObject
+	for _, className := range sortedKeys(det.Objects) {
+		classID, ok := classIDs[className]
+		if !ok {
+			return fmt.Errorf("class %q was not resolved", className)
+		}
+		for _, obj := range det.Objects[className] {
+			rows = append(rows, models.DetectionObject{
+				SnapshotID:          snapshotID,
+				ClassID:             classID,
+				BoxX:                obj.Box.X,
+				BoxY:                obj.Box.Y,
+				BoxW:                obj.Box.W,
+				BoxH:                obj.Box.H,
+				DistanceTopLeft:     obj.Distance.TopLeft,
+				DistanceTopRight:    obj.Distance.TopRight,
+				DistanceBottomLeft:  obj.Distance.BottomLeft,
+				DistanceBottomRight: obj.Distance.BottomRight,
+				MinDistance:         obj.Distance.Min(),
+				Confidence:          obj.Confidence,
+			})
+		}
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return fmt.Errorf("failed to store detection objects: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+// Package export writes snapshot and detection data as files for offline
+// analysis.
+package export
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// Format is an export file format.
+type Format string
+
+const (
+	FormatCSV     Format = "csv"
+	FormatNDJSON  Format = "ndjson"
+	FormatParquet Format = "parquet"
+)
+
+// ParseFormat validates a format name.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatCSV, FormatNDJSON, FormatParquet:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format %q, expected csv, ndjson or parquet", s)
+}
+
+// ContentType is the MIME type of the format.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	case FormatParquet:
+		return "application/vnd.apache.parquet"
+	}
+	return "text/csv"
+}
+
+// Dataset is what an export contains.
+type Dataset string
+
+const (
+	// DatasetSnapshots is one row per snapshot.
+	DatasetSnapshots Dataset = "snapshots"
+	// DatasetObjects is one row per detected object, with its snapshot's
+	// device and capture time.
+	DatasetObjects Dataset = "objects"
+)
+
+// ParseDataset validates a dataset name.
+func ParseDataset(s string) (Dataset, error) {
+	switch d := Dataset(s); d {
+	case DatasetSnapshots, DatasetObjects:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown dataset %q, expected snapshots or objects", s)
+}
+
+// FileName is a name for an export file, e.g. objects-20240102T150405Z.csv.
+func FileName(dataset Dataset, format Format, at time.Time) string {
+	return string(dataset) + "-" + at.UTC().Format("20060102T150405Z") + "." + string(format)
+}
+
+// SnapshotRow is one row of a snapshots export.
+type SnapshotRow struct {
+	ID               int            `json:"id"`
+	DeviceID         int            `json:"device_id"`
+	Name             string         `json:"name"`
+	RpiNo            string         `json:"rpi_no"`
+	CapturedAt       time.Time      `json:"captured_at"`
+	ReceivedAt       time.Time      `json:"received_at"`
+	ClockSkewSeconds *float64       `json:"clock_skew_seconds"`
+	ClockSkewed      bool           `json:"clock_skewed"`
+	DistanceCM       *float64       `gorm:"column:distance_cm" json:"distance_cm"`
+	ClientID         *string        `json:"client_id"`
+	FileAvailable    bool           `json:"file_available"`
+	AuthenticatedURL string         `json:"authenticated_url"`
+	Detection        datatypes.JSON `json:"detection"`
+}
+
+const snapshotColumns = `snapshots.id, snapshots.device_id, snapshots.name, snapshots.rpi_no,
+	snapshots.captured_at, snapshots.received_at, snapshots.clock_skew_seconds, snapshots.clock_skewed,
+	snapshots.distance_cm::float8 AS distance_cm, snapshots.client_id, snapshots.file_available,
+	snapshots.authenticated_url, snapshots.detection`
+
+var snapshotHeader = []string{"id", "device_id", "name", "rpi_no", "captured_at", "received_at",
+	"clock_skew_seconds", "clock_skewed", "distance_cm", "client_id", "file_available",
+	"authenticated_url", "detection"}
+
+func (r SnapshotRow) record() []string {
+	return []string{
+		strconv.Itoa(r.ID), strconv.Itoa(r.DeviceID), r.Name, r.RpiNo,
+		formatTime(r.CapturedAt), formatTime(r.ReceivedAt), formatFloat(r.ClockSkewSeconds),
+		strconv.FormatBool(r.ClockSkewed), formatFloat(r.DistanceCM), formatString(r.ClientID),
+		strconv.FormatBool(r.FileAvailable), r.AuthenticatedURL, string(r.Detection),
+	}
+}
+
+// ObjectRow is one row of an objects export.
+type ObjectRow struct {
+	SnapshotID          int       `json:"snapshot_id"`
+	DeviceID            int       `json:"device_id"`
+	CapturedAt          time.Time `json:"captured_at"`
+	Class               string    `json:"class"`
+	BoxX                float64   `json:"box_x"`
+	BoxY                float64   `json:"box_y"`
+	BoxW                float64   `json:"box_w"`
+	BoxH                float64   `json:"box_h"`
+	DistanceTopLeft     float64   `json:"distance_top_left"`
+	DistanceTopRight    float64   `json:"distance_top_right"`
+	DistanceBottomLeft  float64   `json:"distance_bottom_left"`
+	DistanceBottomRight float64   `json:"distance_bottom_right"`
+	MinDistance         float64   `json:"min_distance"`
+	Confidence          *float64  `json:"confidence"`
+}
+
+const objectColumns = `snapshots.id AS snapshot_id, snapshots.device_id, snapshots.captured_at, c.name AS class,
+	d.box_x, d.box_y, d.box_w, d.box_h, d.distance_top_left, d.distance_top_right,
+	d.distance_bottom_left, d.distance_bottom_right, d.min_distance, d.confidence`
+
+var objectHeader = []string{"snapshot_id", "device_id", "captured_at", "class", "box_x", "box_y",
+	"box_w", "box_h", "distance_top_left", "distance_top_right", "distance_bottom_left",
+	"distance_bottom_right", "min_distance", "confidence"}
+
+func (r ObjectRow) record() []string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return []string{
+		strconv.Itoa(r.SnapshotID), strconv.Itoa(r.DeviceID), formatTime(r.CapturedAt), r.Class,
+		f(r.BoxX), f(r.BoxY), f(r.BoxW), f(r.BoxH), f(r.DistanceTopLeft), f(r.DistanceTopRight),
+		f(r.DistanceBottomLeft), f(r.DistanceBottomRight), f(r.MinDistance), formatFloat(r.Confidence),
+	}
+}
+
+// Query selects the rows of a dataset from a filtered query on snapshots.
+func Query(snapshots *gorm.DB, dataset Dataset) *gorm.DB {
+	if dataset == DatasetObjects {
+		return snapshots.
+			Joins("JOIN detection_objects d ON d.snapshot_id = snapshots.id").
+			Joins("JOIN classes c ON c.id = d.class_id").
+			Select(objectColumns).
+			Order("snapshots.id").Order("d.id")
+	}
+	return snapshots.Select(snapshotColumns).Order("snapshots.id")
+}
+
+// Write streams the rows of a dataset query built with Query to w and
+// returns how many rows were written. Rows are read from a cursor, so the
+// export is never held in memory.
+func Write(w io.Writer, query *gorm.DB, dataset Dataset, format Format) (int, error) {
+	rows, err := query.Rows()
+	if err != nil {
+		return 0, fmt.Errorf("failed to query export rows: %w", err)
+	}
+	defer rows.Close()
+
+	if dataset == DatasetObjects {
+		return writeRows(w, query, rows, format, objectHeader, ObjectRow.record)
+	}
+	return writeRows(w, query, rows, format, snapshotHeader, SnapshotRow.record)
+}
+
+func writeRows[T any](w io.Writer, query *gorm.DB, rows *sql.Rows, format Format, header []string, record func(T) []string) (int, error) {
+	buf := bufio.NewWriter(w)
+	var (
+		csvWriter     *csv.Writer
+		encoder       *json.Encoder
+		parquetWriter *parquetWriter
+	)
+	switch format {
+	case FormatCSV:
+		csvWriter = csv.NewWriter(buf)
+		if err := csvWriter.Write(header); err != nil {
+			return 0, err
+		}
+	case FormatParquet:
+		var err error
+		if parquetWriter, err = newParquetWriter(buf, reflect.TypeFor[T]()); err != nil {
+			return 0, err
+		}
+	default:
+		encoder = json.NewEncoder(buf)
+	}
+
+	n := 0
+	for rows.Next() {
+		var row T
+		if err := query.ScanRows(rows, &row); err != nil {
+			return n, fmt.Errorf("failed to scan export row: %w", err)
+		}
+		var err error
+		switch {
+		case csvWriter != nil:
+			err = csvWriter.Write(record(row))
+		case parquetWriter != nil:
+			err = parquetWriter.Write(reflect.ValueOf(row))
+		default:
+			err = encoder.Encode(row)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("failed to read export rows: %w", err)
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return n, err
+		}
+	}
+	if parquetWriter != nil {
+		if err := parquetWriter.Close(); err != nil {
+			return n, err
+		}
+	}
+	return n, buf.Flush()
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func formatFloat(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+func formatString(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
@@ -0,0 +1,402 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// parquetRowGroupRows is how many rows are buffered before they are written
+// as a row group, which bounds the memory a Parquet export holds.
+const parquetRowGroupRows = 10000
+
+// Parquet physical types, repetitions, converted types and encodings, as
+// numbered in parquet.thrift.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+	parquetJSON            = 19
+
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// parquetColumn buffers the values of one column for the current row group.
+type parquetColumn struct {
+	name      string
+	field     int
+	kind      int32
+	converted int32 // -1 if none
+	optional  bool
+
+	values  bytes.Buffer // PLAIN encoded non-null values
+	bits    []bool       // values of a boolean column
+	defined []bool       // definition levels of an optional column
+	count   int
+}
+
+type parquetRowGroup struct {
+	rows    int
+	size    int64
+	offsets []int64
+	sizes   []int64
+	counts  []int
+}
+
+// parquetWriter writes structs as an uncompressed, PLAIN encoded Parquet
+// file with one flat column per field, named by its json tag. Supported
+// field types are int, float64, bool, string, time.Time, pointers to them
+// and JSON byte slices.
+type parquetWriter struct {
+	w         io.Writer
+	offset    int64
+	columns   []*parquetColumn
+	rows      int
+	rowGroups []parquetRowGroup
+}
+
+func newParquetWriter(w io.Writer, rowType reflect.Type) (*parquetWriter, error) {
+	pw := &parquetWriter{w: w}
+	for i := 0; i < rowType.NumField(); i++ {
+		field := rowType.Field(i)
+		column := &parquetColumn{name: strings.Split(field.Tag.Get("json"), ",")[0], field: i, converted: -1}
+		t := field.Type
+		if t.Kind() == reflect.Pointer {
+			column.optional = true
+			t = t.Elem()
+		}
+		switch {
+		case t == timeType:
+			column.kind, column.converted = parquetInt64, parquetTimestampMicros
+		case t.Kind() == reflect.Int:
+			column.kind = parquetInt64
+		case t.Kind() == reflect.Float64:
+			column.kind = parquetDouble
+		case t.Kind() == reflect.Bool:
+			column.kind = parquetBoolean
+		case t.Kind() == reflect.String:
+			column.kind, column.converted = parquetByteArray, parquetUTF8
+		case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+			// Empty JSON is written as null
+			column.kind, column.converted, column.optional = parquetByteArray, parquetJSON, true
+		default:
+			return nil, fmt.Errorf("parquet: unsupported type %s of field %s", field.Type, field.Name)
+		}
+		pw.columns = append(pw.columns, column)
+	}
+	return pw, pw.write([]byte("PAR1"))
+}
+
+func (pw *parquetWriter) write(p []byte) error {
+	n, err := pw.w.Write(p)
+	pw.offset += int64(n)
+	return err
+}
+
+// Write adds one row, flushing a row group once enough rows are buffered.
+func (pw *parquetWriter) Write(row reflect.Value) error {
+	for _, column := range pw.columns {
+		column.add(row.Field(column.field))
+	}
+	pw.rows++
+	if pw.rows == parquetRowGroupRows {
+		return pw.flush()
+	}
+	return nil
+}
+
+func (column *parquetColumn) add(v reflect.Value) {
+	column.count++
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			column.defined = append(column.defined, false)
+			return
+		}
+		v = v.Elem()
+	} else if column.converted == parquetJSON && v.Len() == 0 {
+		column.defined = append(column.defined, false)
+		return
+	}
+	if column.optional {
+		column.defined = append(column.defined, true)
+	}
+
+	var buf [8]byte
+	switch column.kind {
+	case parquetBoolean:
+		column.bits = append(column.bits, v.Bool())
+	case parquetInt64:
+		n := v.Interface()
+		if t, ok := n.(time.Time); ok {
+			binary.LittleEndian.PutUint64(buf[:], uint64(t.UnixMicro()))
+		} else {
+			binary.LittleEndian.PutUint64(buf[:], uint64(v.Int()))
+		}
+		column.values.Write(buf[:])
+	case parquetDouble:
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v.Float()))
+		column.values.Write(buf[:])
+	case parquetByteArray:
+		var b []byte
+		if v.Kind() == reflect.String {
+			b = []byte(v.String())
+		} else {
+			b = v.Bytes()
+		}
+		binary.LittleEndian.PutUint32(buf[:4], uint32(len(b)))
+		column.values.Write(buf[:4])
+		column.values.Write(b)
+	}
+}
+
+// flush writes the buffered rows as a row group with one data page per
+// column.
+func (pw *parquetWriter) flush() error {
+	if pw.rows == 0 {
+		return nil
+	}
+	group := parquetRowGroup{rows: pw.rows}
+	for _, column := range pw.columns {
+		var page bytes.Buffer
+		if column.optional {
+			levels := bitPackedHybrid(column.defined)
+			var length [4]byte
+			binary.LittleEndian.PutUint32(length[:], uint32(len(levels)))
+			page.Write(length[:])
+			page.Write(levels)
+		}
+		if column.kind == parquetBoolean {
+			page.Write(packBits(column.bits))
+		} else {
+			page.Write(column.values.Bytes())
+		}
+
+		header := &compactWriter{}
+		header.begin()
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(page.Len()))
+		header.i32(3, int32(page.Len()))
+		header.structField(5)
+		header.i32(1, int32(column.count))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.end()
+		header.end()
+
+		group.offsets = append(group.offsets, pw.offset)
+		if err := pw.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(page.Bytes()); err != nil {
+			return err
+		}
+		size := int64(header.buf.Len() + page.Len())
+		group.sizes = append(group.sizes, size)
+		group.counts = append(group.counts, column.count)
+		group.size += size
+
+		column.values.Reset()
+		column.bits = column.bits[:0]
+		column.defined = column.defined[:0]
+		column.count = 0
+	}
+	pw.rowGroups = append(pw.rowGroups, group)
+	pw.rows = 0
+	return nil
+}
+
+// Close writes the remaining rows and the file footer.
+func (pw *parquetWriter) Close() error {
+	if err := pw.flush(); err != nil {
+		return err
+	}
+
+	var numRows int64
+	for _, group := range pw.rowGroups {
+		numRows += int64(group.rows)
+	}
+
+	meta := &compactWriter{}
+	meta.begin()
+	meta.i32(1, 1)
+	meta.list(2, ctStruct, len(pw.columns)+1)
+	meta.begin()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(pw.columns)))
+	meta.end()
+	for _, column := range pw.columns {
+		meta.begin()
+		meta.i32(1, column.kind)
+		repetition := int32(parquetRequired)
+		if column.optional {
+			repetition = parquetOptional
+		}
+		meta.i32(3, repetition)
+		meta.binary(4, column.name)
+		if column.converted >= 0 {
+			meta.i32(6, column.converted)
+		}
+		meta.end()
+	}
+	meta.i64(3, numRows)
+	meta.list(4, ctStruct, len(pw.rowGroups))
+	for _, group := range pw.rowGroups {
+		meta.begin()
+		meta.list(1, ctStruct, len(pw.columns))
+		for i, column := range pw.columns {
+			meta.begin()
+			meta.i64(2, group.offsets[i])
+			meta.structField(3)
+			meta.i32(1, column.kind)
+			meta.list(2, ctI32, 2)
+			meta.listI32(parquetPlain)
+			meta.listI32(parquetRLE)
+			meta.list(3, ctBinary, 1)
+			meta.listBinary(column.name)
+			meta.i32(4, 0) // UNCOMPRESSED
+			meta.i64(5, int64(group.counts[i]))
+			meta.i64(6, group.sizes[i])
+			meta.i64(7, group.sizes[i])
+			meta.i64(9, group.offsets[i])
+			meta.end()
+			meta.end()
+		}
+		meta.i64(2, group.size)
+		meta.i64(3, int64(group.rows))
+		meta.end()
+	}
+	meta.binary(6, "aisense_portal_snapshot")
+	meta.end()
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(meta.buf.Len()))
+	if err := pw.write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := pw.write(length[:]); err != nil {
+		return err
+	}
+	return pw.write([]byte("PAR1"))
+}
+
+// packBits packs booleans eight to a byte, least significant bit first.
+func packBits(bits []bool) []byte {
+	packed := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	return packed
+}
+
+// bitPackedHybrid encodes levels of bit width 1 as a single bit-packed run
+// of the RLE/bit-packing hybrid encoding.
+func bitPackedHybrid(levels []bool) []byte {
+	packed := packBits(levels)
+	header := binary.AppendUvarint(nil, uint64(len(packed))<<1|1)
+	return append(header, packed...)
+}
+
+// Thrift compact protocol type ids.
+const (
+	ctI32    = 5
+	ctI64    = 6
+	ctBinary = 8
+	ctList   = 9
+	ctStruct = 12
+)
+
+// compactWriter encodes the Thrift structs of the Parquet footer and page
+// headers with the compact protocol.
+type compactWriter struct {
+	buf  bytes.Buffer
+	last []int16 // id of the last field written in each open struct
+}
+
+// begin opens a struct that is the top-level value or a list element.
+func (w *compactWriter) begin() {
+	w.last = append(w.last, 0)
+}
+
+// end closes the innermost struct.
+func (w *compactWriter) end() {
+	w.buf.WriteByte(0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+func (w *compactWriter) field(id int16, typ byte) {
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.buf.WriteByte(typ)
+		w.uvarint(zigzag(int64(id)))
+	}
+	*last = id
+}
+
+func (w *compactWriter) uvarint(v uint64) {
+	w.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func (w *compactWriter) i32(id int16, v int32) {
+	w.field(id, ctI32)
+	w.uvarint(zigzag(int64(v)))
+}
+
+func (w *compactWriter) i64(id int16, v int64) {
+	w.field(id, ctI64)
+	w.uvarint(zigzag(v))
+}
+
+func (w *compactWriter) binary(id int16, v string) {
+	w.field(id, ctBinary)
+	w.listBinary(v)
+}
+
+// structField opens a struct valued field; close it with end.
+func (w *compactWriter) structField(id int16) {
+	w.field(id, ctStruct)
+	w.begin()
+}
+
+// list starts a list field of n elements of type elem, which follow.
+func (w *compactWriter) list(id int16, elem byte, n int) {
+	w.field(id, ctList)
+	if n < 15 {
+		w.buf.WriteByte(byte(n)<<4 | elem)
+		return
+	}
+	w.buf.WriteByte(0xf0 | elem)
+	w.uvarint(uint64(n))
+}
+
+func (w *compactWriter) listI32(v int32) {
+	w.uvarint(zigzag(int64(v)))
+}
+
+func (w *compactWriter) listBinary(v string) {
+	w.uvarint(uint64(len(v)))
+	w.buf.WriteString(v)
+}
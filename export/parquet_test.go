@@ -0,0 +1,129 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestParquetRoundTrip(t *testing.T) {
+	captured := time.Date(2024, 1, 2, 15, 4, 5, 123456000, time.UTC)
+	rows := make([]SnapshotRow, parquetRowGroupRows*2+3)
+	for i := range rows {
+		row := SnapshotRow{
+			ID:               i + 1,
+			DeviceID:         i % 7,
+			Name:             fmt.Sprintf("snapshot-%d.jpg", i),
+			RpiNo:            "rpi",
+			CapturedAt:       captured.Add(time.Duration(i) * time.Second),
+			ReceivedAt:       captured,
+			ClockSkewed:      i%3 == 0,
+			FileAvailable:    i%2 == 1,
+			AuthenticatedURL: "",
+		}
+		if i%2 == 0 {
+			distance := float64(i) / 4
+			clientID := fmt.Sprintf("client-%d", i)
+			row.DistanceCM = &distance
+			row.ClientID = &clientID
+			row.Detection = []byte(fmt.Sprintf(`{"objects":{"person":[%d]}}`, i))
+		}
+		rows[i] = row
+	}
+
+	var buf bytes.Buffer
+	pw, err := newParquetWriter(&buf, reflect.TypeFor[SnapshotRow]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err := pw.Write(reflect.ValueOf(row)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := buffer.NewBufferFile(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := reader.NewParquetColumnReader(file, 1)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer pr.ReadStop()
+
+	if got := pr.GetNumRows(); got != int64(len(rows)) {
+		t.Fatalf("num rows = %d, want %d", got, len(rows))
+	}
+	if got := len(pr.Footer.RowGroups); got != 3 {
+		t.Fatalf("row groups = %d, want 3", got)
+	}
+
+	schema := pr.Footer.Schema[1:]
+	if len(schema) != len(snapshotHeader) {
+		t.Fatalf("columns = %d, want %d", len(schema), len(snapshotHeader))
+	}
+	// The reader capitalises names in the footer it returns; ExName keeps
+	// the names as written
+	for i := range schema {
+		if name := pr.SchemaHandler.Infos[i+1].ExName; name != snapshotHeader[i] {
+			t.Errorf("column %d = %q, want %q", i, name, snapshotHeader[i])
+		}
+	}
+	if ct := schema[4].ConvertedType; ct == nil || *ct != parquet.ConvertedType_TIMESTAMP_MICROS {
+		t.Errorf("captured_at converted type = %v, want TIMESTAMP_MICROS", ct)
+	}
+	if ct := schema[12].ConvertedType; ct == nil || *ct != parquet.ConvertedType_JSON {
+		t.Errorf("detection converted type = %v, want JSON", ct)
+	}
+
+	columns := make([][]any, len(schema))
+	for i := range schema {
+		values, _, _, err := pr.ReadColumnByIndex(int64(i), int64(len(rows)))
+		if err != nil {
+			t.Fatalf("failed to read column %s: %v", schema[i].Name, err)
+		}
+		if len(values) != len(rows) {
+			t.Fatalf("column %s has %d values, want %d", schema[i].Name, len(values), len(rows))
+		}
+		columns[i] = values
+	}
+
+	str := func(v *string) any {
+		if v == nil {
+			return nil
+		}
+		return *v
+	}
+	float := func(v *float64) any {
+		if v == nil {
+			return nil
+		}
+		return *v
+	}
+	for i, row := range rows {
+		var detection any
+		if len(row.Detection) > 0 {
+			detection = string(row.Detection)
+		}
+		want := []any{
+			int64(row.ID), int64(row.DeviceID), row.Name, row.RpiNo,
+			row.CapturedAt.UnixMicro(), row.ReceivedAt.UnixMicro(), nil, row.ClockSkewed,
+			float(row.DistanceCM), str(row.ClientID), row.FileAvailable, row.AuthenticatedURL, detection,
+		}
+		for c, w := range want {
+			if got := columns[c][i]; got != w {
+				t.Fatalf("row %d column %s = %#v, want %#v", i, schema[c].Name, got, w)
+			}
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -17,7 +16,7 @@ func CreateBucket(projectID, bucketName, location string) error {
 	ctx := context.Background()
 
 	// Use your service account key JSON file
-	client, err := storage.NewClient(ctx, option.WithCredentialsFile(os.Getenv("SERVICE_ACCOUNT_JSON_FILE_PATH")))
+	client, err := storage.NewClient(ctx, option.WithCredentialsFile(credentialsFile))
 	if err != nil {
 		log.Panicln(err)
 		return fmt.Errorf("failed to create client: %v", err)
@@ -52,13 +51,7 @@ func CreateBucket(projectID, bucketName, location string) error {
 func BucketExists(bucketName string) (bool, error) {
 	ctx := context.Background()
 
-	println(bucketName)
-
-	credentialPath := os.Getenv("SERVICE_ACCOUNT_JSON_FILE_PATH")
-
-	println(credentialPath)
-
-	client, err := storage.NewClient(ctx, option.WithCredentialsFile(credentialPath))
+	client, err := storage.NewClient(ctx, option.WithCredentialsFile(credentialsFile))
 	if err != nil {
 		return false, fmt.Errorf("failed to create storage client: %v", err)
 	}
@@ -0,0 +1,32 @@
+package gcs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/config"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+)
+
+var (
+	credentialsFile string
+	serviceAccount  models.ServiceAccount
+)
+
+// Init loads the service account used for every GCS call and URL signature.
+func Init(cfg config.GCSConfig) error {
+	saBytes, err := os.ReadFile(cfg.CredentialsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read service account file: %w", err)
+	}
+
+	var sa models.ServiceAccount
+	if err := json.Unmarshal(saBytes, &sa); err != nil {
+		return fmt.Errorf("failed to parse service account JSON: %w", err)
+	}
+
+	credentialsFile = cfg.CredentialsFile
+	serviceAccount = sa
+	return nil
+}
@@ -2,7 +2,6 @@ package gcs
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/url"
@@ -12,15 +11,12 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
-	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
 	"google.golang.org/api/option"
 )
 
 func UploadFileAndGetGCSUri(bucketName, objectName, localFilePath string) (string, error) {
 	ctx := context.Background()
-	serviceAccountPath := os.Getenv("SERVICE_ACCOUNT_JSON_FILE_PATH")
-
-	client, err := storage.NewClient(ctx, option.WithCredentialsFile(serviceAccountPath))
+	client, err := storage.NewClient(ctx, option.WithCredentialsFile(credentialsFile))
 	if err != nil {
 		return "", fmt.Errorf("failed to create GCS client: %w", err)
 	}
@@ -49,9 +45,7 @@ func UploadFileAndGetGCSUri(bucketName, objectName, localFilePath string) (strin
 
 func UploadFileAndGetGCSUriReader(bucketName, objectName string, r io.Reader) (string, error) {
 	ctx := context.Background()
-	serviceAccountPath := os.Getenv("SERVICE_ACCOUNT_JSON_FILE_PATH")
-
-	client, err := storage.NewClient(ctx, option.WithCredentialsFile(serviceAccountPath))
+	client, err := storage.NewClient(ctx, option.WithCredentialsFile(credentialsFile))
 	if err != nil {
 		return "", fmt.Errorf("failed to create GCS client: %w", err)
 	}
@@ -86,21 +80,10 @@ func GenerateSignedURL(gsURI string, expiryDuration time.Duration) (string, erro
 		return "", fmt.Errorf("failed to unescape object name: %w", err)
 	}
 
-	// Load service account credentials
-	serviceAccountPath := os.Getenv("SERVICE_ACCOUNT_JSON_FILE_PATH")
-
-	saBytes, err := os.ReadFile(serviceAccountPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read service account file: %w", err)
-	}
-
-	var sa models.ServiceAccount
-	if err := json.Unmarshal(saBytes, &sa); err != nil {
-		return "", fmt.Errorf("failed to parse service account JSON: %w", err)
-	}
+	sa := serviceAccount
 
 	// Initialize storage client
-	client, err := storage.NewClient(context.Background(), option.WithCredentialsFile(serviceAccountPath))
+	client, err := storage.NewClient(context.Background(), option.WithCredentialsFile(credentialsFile))
 	if err != nil {
 		return "", fmt.Errorf("failed to create storage client: %w", err)
 	}
@@ -154,9 +137,7 @@ func DeleteObjectByURI(gsURI string) error {
 	objectName := parts[1]
 
 	ctx := context.Background()
-	serviceAccountPath := os.Getenv("SERVICE_ACCOUNT_JSON_FILE_PATH")
-
-	client, err := storage.NewClient(ctx, option.WithCredentialsFile(serviceAccountPath))
+	client, err := storage.NewClient(ctx, option.WithCredentialsFile(credentialsFile))
 	if err != nil {
 		return fmt.Errorf("failed to create GCS client: %w", err)
 	}
@@ -171,7 +152,8 @@ func DeleteObjectByURI(gsURI string) error {
 	return nil
 }
 
-func parseGCSURI(gsURI string) (bucket, object string, err error) {
+// ParseGCSURI splits a gs://bucket/object URI into its bucket and object names.
+func ParseGCSURI(gsURI string) (bucket, object string, err error) {
 	if !strings.HasPrefix(gsURI, "gs://") {
 		return "", "", fmt.Errorf("invalid GCS URI: %s", gsURI)
 	}
@@ -185,7 +167,7 @@ func parseGCSURI(gsURI string) (bucket, object string, err error) {
 
 func DeleteBulkObjects(gsURIs []string) error {
 	ctx := context.Background()
-	client, err := storage.NewClient(ctx, option.WithCredentialsFile(os.Getenv("SERVICE_ACCOUNT_JSON_FILE_PATH")))
+	client, err := storage.NewClient(ctx, option.WithCredentialsFile(credentialsFile))
 	if err != nil {
 		return fmt.Errorf("failed to create GCS client: %w", err)
 	}
@@ -197,7 +179,7 @@ func DeleteBulkObjects(gsURIs []string) error {
 	var errs []error
 
 	for _, uri := range gsURIs {
-		bucket, object, err := parseGCSURI(uri)
+		bucket, object, err := ParseGCSURI(uri)
 		if err != nil {
 			errs = append(errs, err)
 			continue
@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/alert"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/detection"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const webhookSecretPrefix = "whsec_"
+
+// findDevice writes a 400 or 404 response itself unless the :id device exists.
+func findDevice(c *gin.Context) (int, bool) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return 0, false
+	}
+	if err := db.DB.Select("id").First(&models.Device{}, deviceID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return 0, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return 0, false
+	}
+	return deviceID, true
+}
+
+// alertRuleRequest is the body of CreateAlertRule and UpdateAlertRule; unset
+// fields keep their value on update.
+type alertRuleRequest struct {
+	Class           *string  `json:"class"`
+	MaxDistanceCM   *float64 `json:"max_distance_cm"`
+	MinCount        *int     `json:"min_count"`
+	CooldownSeconds *int     `json:"cooldown_seconds"`
+	Enabled         *bool    `json:"enabled"`
+}
+
+// apply copies the set fields onto rule and validates the result.
+func (r alertRuleRequest) apply(rule *models.AlertRule) error {
+	if r.Class != nil {
+		rule.Class = *r.Class
+	}
+	if r.MaxDistanceCM != nil {
+		rule.MaxDistanceCM = *r.MaxDistanceCM
+	}
+	if r.MinCount != nil {
+		rule.MinCount = *r.MinCount
+	}
+	if r.CooldownSeconds != nil {
+		rule.CooldownSeconds = *r.CooldownSeconds
+	}
+	if r.Enabled != nil {
+		rule.Enabled = *r.Enabled
+	}
+
+	switch {
+	case !detection.ValidClassName(rule.Class):
+		return errors.New("class is not a valid class name")
+	case rule.MaxDistanceCM <= 0:
+		return errors.New("max_distance_cm must be positive")
+	case rule.MinCount < 1:
+		return errors.New("min_count must be at least 1")
+	case rule.CooldownSeconds < 0:
+		return errors.New("cooldown_seconds must not be negative")
+	}
+	return nil
+}
+
+// CreateAlertRule adds a proximity alert rule to a device: at least
+// min_count (default 1) objects of class, its aliases or child classes
+// within max_distance_cm fire an alert, then the rule is silent for
+// cooldown_seconds.
+func CreateAlertRule(c *gin.Context) {
+	deviceID, ok := findDevice(c)
+	if !ok {
+		return
+	}
+
+	var request alertRuleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	if request.Class == nil || request.MaxDistanceCM == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "class and max_distance_cm are required"})
+		return
+	}
+
+	rule := models.AlertRule{DeviceID: deviceID, MinCount: 1, Enabled: true}
+	if err := request.apply(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := db.DB.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create alert rule: " + err.Error()})
+		return
+	}
+	audit.SetTargets(c, "device:"+c.Param("id"), "alert_rule:"+strconv.Itoa(rule.ID))
+
+	c.JSON(http.StatusCreated, gin.H{"alert_rule": rule})
+}
+
+// ListAlertRules lists a device's alert rules.
+func ListAlertRules(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+
+	var rules []models.AlertRule
+	if err := db.DB.Where("device_id = ?", deviceID).Order("id").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"alert_rules": rules})
+}
+
+// UpdateAlertRule changes the given fields of a device's alert rule.
+func UpdateAlertRule(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+	ruleID, err := strconv.Atoi(c.Param("ruleId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert rule id"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+c.Param("id"), "alert_rule:"+c.Param("ruleId"))
+
+	var request alertRuleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	var rule models.AlertRule
+	if err := db.DB.Where("id = ? AND device_id = ?", ruleID, deviceID).First(&rule).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Alert rule not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	if err := request.apply(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = db.DB.Model(&rule).Select("class", "max_distance_cm", "min_count", "cooldown_seconds", "enabled", "updated_at").Updates(&rule).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update alert rule: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"alert_rule": rule})
+}
+
+// DeleteAlertRule removes a device's alert rule. Its delivery log is kept.
+func DeleteAlertRule(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+	ruleID, err := strconv.Atoi(c.Param("ruleId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert rule id"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+c.Param("id"), "alert_rule:"+c.Param("ruleId"))
+
+	result := db.DB.Where("id = ? AND device_id = ?", ruleID, deviceID).Delete(&models.AlertRule{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete alert rule: " + result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert rule deleted successfully"})
+}
+
+// CreateAlertWebhook registers an http(s) URL to receive a device's alerts.
+// The signing secret is only returned in this response.
+func CreateAlertWebhook(c *gin.Context) {
+	deviceID, ok := findDevice(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		URL string `json:"url" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	if err := alert.CheckURL(c.Request.Context(), request.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := auth.GenerateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	webhook := models.AlertWebhook{
+		DeviceID: deviceID,
+		URL:      request.URL,
+		Secret:   webhookSecretPrefix + token,
+		Enabled:  true,
+	}
+	if err := db.DB.Create(&webhook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook: " + err.Error()})
+		return
+	}
+	audit.SetTargets(c, "device:"+c.Param("id"), "webhook:"+strconv.Itoa(webhook.ID))
+
+	c.JSON(http.StatusCreated, gin.H{
+		"webhook": webhook,
+		"secret":  webhook.Secret,
+		"note":    "Store this secret now; it cannot be shown again. Deliveries carry " + alert.SignatureHeader + ": sha256=HMAC-SHA256(secret, " + alert.TimestampHeader + " + \".\" + body)",
+	})
+}
+
+// ListAlertWebhooks lists a device's webhooks without their secrets.
+func ListAlertWebhooks(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+
+	var webhooks []models.AlertWebhook
+	if err := db.DB.Where("device_id = ?", deviceID).Order("id").Find(&webhooks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+// DeleteAlertWebhook removes one of a device's webhooks.
+func DeleteAlertWebhook(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+	webhookID, err := strconv.Atoi(c.Param("webhookId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook id"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+c.Param("id"), "webhook:"+c.Param("webhookId"))
+
+	result := db.DB.Where("id = ? AND device_id = ?", webhookID, deviceID).Delete(&models.AlertWebhook{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook: " + result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// ListAlertDeliveries is the alert delivery log of the devices visible to the
+// user, newest first, filtered by optional device_id, rule_id and status
+// (pending, delivered or failed).
+func ListAlertDeliveries(c *gin.Context) {
+	claims, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+		return
+	}
+
+	query := scopeDeviceRows(db.DB.Model(&models.AlertDelivery{}), claims, "device_id")
+	for _, param := range []string{"device_id", "rule_id"} {
+		if v := c.Query(param); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+				return
+			}
+			query = query.Where(param+" = ?", id)
+		}
+	}
+	if v := c.Query("status"); v != "" {
+		query = query.Where("status = ?", v)
+	}
+
+	var deliveries []models.AlertDelivery
+	if err := query.Order("id DESC").Limit(maxPageSize).Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// RedeliverAlert sends a logged alert to its webhook again, with a fresh
+// round of retries.
+func RedeliverAlert(c *gin.Context) {
+	claims, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery id"})
+		return
+	}
+
+	audit.SetTargets(c, "alert_delivery:"+c.Param("id"))
+
+	// Deliveries of other users' devices look the same as missing ones
+	var delivery models.AlertDelivery
+	if err := scopeDeviceRows(db.DB, claims, "device_id").First(&delivery, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	var webhook models.AlertWebhook
+	if err := db.DB.First(&webhook, delivery.WebhookID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusConflict, gin.H{"error": "The delivery's webhook was deleted"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	if err := alert.Requeue(delivery.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+	if err := db.DB.First(&delivery, delivery.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"delivery": delivery})
+}
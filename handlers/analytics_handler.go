@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/detection"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+)
+
+const defaultAnalyticsRange = 7 * 24 * time.Hour
+
+// analyticsBuckets are the supported time buckets and the longest range each
+// may be queried over, which bounds the number of result rows.
+var analyticsBuckets = map[string]time.Duration{
+	"minute": 2 * 24 * time.Hour,
+	"hour":   92 * 24 * time.Hour,
+	"day":    3 * 366 * 24 * time.Hour,
+	"week":   10 * 366 * 24 * time.Hour,
+}
+
+// detectionAnalyticsSQL aggregates per device, class and bucket. frames is
+// the set of snapshots in range with their local time bucket; averages are
+// over all frames of the device in the bucket, including frames without the
+// class.
+const detectionAnalyticsSQL = `WITH frames AS (?),
+	frame_counts AS (
+		SELECT device_id, bucket, COUNT(*) AS frames FROM frames GROUP BY device_id, bucket
+	),
+	per_frame AS (
+		SELECT f.device_id, f.bucket, d.class_id, COUNT(*) AS objects
+		FROM frames f JOIN detection_objects d ON d.snapshot_id = f.id
+		WHERE ? OR d.class_id IN (` + detection.ClassTreeSQL + `)
+		GROUP BY f.id, f.device_id, f.bucket, d.class_id
+	)
+	SELECT p.device_id, c.name AS class, p.bucket, fc.frames,
+		COUNT(*) AS frames_with_class,
+		SUM(p.objects) AS objects,
+		SUM(p.objects)::float8 / fc.frames AS avg_per_frame,
+		MAX(p.objects) AS max_per_frame
+	FROM per_frame p
+	JOIN frame_counts fc ON fc.device_id = p.device_id AND fc.bucket = p.bucket
+	JOIN classes c ON c.id = p.class_id
+	GROUP BY p.device_id, c.name, p.bucket, fc.frames
+	ORDER BY p.bucket, p.device_id, c.name`
+
+type detectionAnalyticsRow struct {
+	DeviceID        int       `json:"device_id"`
+	Class           string    `json:"class"`
+	Bucket          time.Time `json:"-"`
+	BucketStart     string    `json:"bucket"`
+	Frames          int       `json:"frames"`
+	FramesWithClass int       `json:"frames_with_class"`
+	Objects         int       `json:"objects"`
+	AvgPerFrame     float64   `json:"avg_per_frame"`
+	MaxPerFrame     int       `json:"max_per_frame"`
+}
+
+// DetectionAnalytics aggregates detected objects of the snapshots visible to
+// the user by device, class and time bucket (bucket=minute|hour|day|week,
+// default hour). Buckets are in each device's time zone unless tz overrides
+// it. Optional filters are device_id, class (with aliases and child classes)
+// and from/to (captured_at, RFC 3339; default the last 7 days).
+func DetectionAnalytics(c *gin.Context) {
+	claims, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+		return
+	}
+
+	unit := c.DefaultQuery("bucket", "hour")
+	maxRange, ok := analyticsBuckets[unit]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bucket must be minute, hour, day or week"})
+		return
+	}
+
+	to := time.Now()
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' time, expected RFC 3339"})
+			return
+		}
+		to = t
+	}
+	from := to.Add(-defaultAnalyticsRange)
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' time, expected RFC 3339"})
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "'from' must be before 'to'"})
+		return
+	}
+	if to.Sub(from) > maxRange {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Time range is too long for bucket " + unit + "; use a larger bucket"})
+		return
+	}
+
+	zone := "COALESCE(device_timezones.timezone, 'UTC')"
+	var zoneArgs []any
+	if tz := c.Query("tz"); tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown time zone"})
+			return
+		}
+		zone = "?"
+		zoneArgs = append(zoneArgs, tz)
+	}
+
+	frames := scopeSnapshots(db.DB.Model(&models.Snapshot{}), claims).
+		Select("snapshots.id, snapshots.device_id, date_trunc(?, snapshots.captured_at AT TIME ZONE "+zone+") AS bucket", append([]any{unit}, zoneArgs...)...).
+		Joins("LEFT JOIN device_timezones ON device_timezones.device_id = snapshots.device_id").
+		Where("snapshots.captured_at >= ? AND snapshots.captured_at < ?", from, to)
+	if v := c.Query("device_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device_id"})
+			return
+		}
+		frames = frames.Where("snapshots.device_id = ?", id)
+	}
+
+	class := c.Query("class")
+	var rows []detectionAnalyticsRow
+	err := db.DB.Raw(detectionAnalyticsSQL, frames, class == "", class, detection.NormalizeAlias(class)).Scan(&rows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	// Buckets are local wall-clock times, so they are returned without an offset
+	for i := range rows {
+		rows[i].BucketStart = rows[i].Bucket.Format("2006-01-02T15:04:05")
+	}
+	if rows == nil {
+		rows = []detectionAnalyticsRow{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"bucket": unit,
+		"from":   from,
+		"to":     to,
+		"rows":   rows,
+	})
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// ListAuditEvents returns audit events, newest first, filtered by actor_type,
+// actor_id, action, result, target and a from/to range (RFC 3339), paginated
+// with page and page_size.
+func ListAuditEvents(c *gin.Context) {
+	query := db.DB.Model(&models.AuditEvent{})
+
+	if actorType := c.Query("actor_type"); actorType != "" {
+		query = query.Where("actor_type = ?", actorType)
+	}
+	if actorID := c.Query("actor_id"); actorID != "" {
+		id, err := strconv.Atoi(actorID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid actor_id"})
+			return
+		}
+		query = query.Where("actor_id = ?", id)
+	}
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if result := c.Query("result"); result != "" {
+		query = query.Where("result = ?", result)
+	}
+	if target := c.Query("target"); target != "" {
+		targetJSON, _ := json.Marshal([]string{target})
+		query = query.Where("targets @> ?", string(targetJSON))
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' time, expected RFC 3339"})
+			return
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' time, expected RFC 3339"})
+			return
+		}
+		query = query.Where("created_at < ?", t)
+	}
+
+	page, pageSize, ok := pagination(c)
+	if !ok {
+		return
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	var events []models.AuditEvent
+	err := query.Order("created_at DESC, id DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&events).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events":    events,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// pagination reads the page and page_size query parameters. It writes the
+// error response itself and reports whether they were valid.
+func pagination(c *gin.Context) (page, pageSize int, ok bool) {
+	page, pageSize = 1, defaultPageSize
+
+	if v := c.Query("page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page"})
+			return 0, 0, false
+		}
+		page = p
+	}
+	if v := c.Query("page_size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 1 || size > maxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "page_size must be between 1 and " + strconv.Itoa(maxPageSize)})
+			return 0, 0, false
+		}
+		pageSize = size
+	}
+
+	return page, pageSize, true
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const refreshTokenTTL = 7 * 24 * time.Hour
+
+func Login(c *gin.Context) {
+	var request struct {
+		Email    string `json:"email" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	audit.SetTargets(c, request.Email)
+
+	var user models.User
+	if err := db.DB.Where("LOWER(email) = ?", strings.ToLower(request.Email)).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		return
+	}
+	if user.Password == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		return
+	}
+	ok, needsRehash := auth.VerifyPassword(*user.Password, request.Password)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		return
+	}
+
+	audit.SetActor(c, audit.ActorUser, user.ID)
+
+	now := time.Now()
+	updates := map[string]any{"last_login": now, "last_login_ip": c.ClientIP()}
+
+	// Transparently upgrade legacy plaintext or outdated hashes
+	if needsRehash {
+		if hash, err := auth.HashPassword(request.Password); err == nil {
+			updates["password"] = hash
+		}
+	}
+
+	if err := db.DB.Model(&user).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record login: " + err.Error()})
+		return
+	}
+
+	tokens, err := issueTokens(db.DB, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// RefreshToken rotates a refresh token and returns a new token pair.
+func RefreshToken(c *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	tx := db.DB.Begin()
+
+	var stored models.RefreshToken
+	err := tx.Where("token_hash = ? AND revoked_at IS NULL AND expires_at > ?", auth.HashToken(request.RefreshToken), time.Now()).
+		First(&stored).Error
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	}
+
+	audit.SetActor(c, audit.ActorUser, stored.UserID)
+
+	var user models.User
+	if err := tx.First(&user, stored.UserID).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Rotate: the presented refresh token can only be used once
+	result := tx.Model(&models.RefreshToken{}).
+		Where("id = ? AND revoked_at IS NULL", stored.ID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil || result.RowsAffected == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	}
+
+	tokens, err := issueTokens(tx, user)
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// Logout revokes the given refresh token (or all of the user's refresh tokens
+// when none is given) and records the logout time and IP.
+func Logout(c *gin.Context) {
+	claims, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+		return
+	}
+
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	// Body is optional
+	_ = c.ShouldBindJSON(&request)
+
+	now := time.Now()
+	revoke := db.DB.Model(&models.RefreshToken{}).Where("user_id = ? AND revoked_at IS NULL", claims.UserID)
+	if request.RefreshToken != "" {
+		revoke = revoke.Where("token_hash = ?", auth.HashToken(request.RefreshToken))
+	}
+	if err := revoke.Update("revoked_at", now).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke refresh token: " + err.Error()})
+		return
+	}
+
+	err := db.DB.Model(&models.User{}).Where("id = ?", claims.UserID).
+		Updates(map[string]any{"last_logout": now, "last_logout_ip": c.ClientIP()}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record logout: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// issueTokens creates a new access/refresh token pair for the user and
+// returns the response body describing it.
+func issueTokens(tx *gorm.DB, user models.User) (gin.H, error) {
+	accessToken, accessExpiresAt, err := auth.IssueAccessToken(user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue access token: %w", err)
+	}
+
+	refreshToken, err := auth.GenerateToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue refresh token: %w", err)
+	}
+
+	stored := models.RefreshToken{
+		UserID:    user.ID,
+		TokenHash: auth.HashToken(refreshToken),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	}
+	if err := tx.Create(&stored).Error; err != nil {
+		return nil, fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	return gin.H{
+		"access_token":       accessToken,
+		"token_type":         "Bearer",
+		"expires_at":         accessExpiresAt,
+		"refresh_token":      refreshToken,
+		"refresh_expires_at": stored.ExpiresAt,
+	}, nil
+}
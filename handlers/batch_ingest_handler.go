@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxBatchImageSize = 10 << 20
+	maxBatchFieldSize = 1 << 20
+)
+
+// batchItemResult is the outcome of one item of a batch upload.
+type batchItemResult struct {
+	Index    int              `json:"index"`
+	Filename string           `json:"filename"`
+	Status   int              `json:"status"`
+	Snapshot *models.Snapshot `json:"snapshot,omitempty"`
+	Replayed bool             `json:"replayed,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Fields   any              `json:"fields,omitempty"`
+}
+
+// CreateSnapshotBatch ingests many snapshots from one streamed multipart
+// body. Each item is sent as its fields (detection, and optionally
+// captured_at, sent_at, client_id, signature, timestamp and nonce) followed
+// by its image part; the image part completes the item. Items are processed
+// with bounded concurrency as they arrive, each counts against the device's
+// ingest rate limit, and the response lists a result per item in upload
+// order.
+func CreateSnapshotBatch(c *gin.Context) {
+	device, ok := middleware.CurrentDevice(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Device is not authenticated"})
+		return
+	}
+	apiKeyID := middleware.CurrentDeviceAPIKeyID(c)
+
+	if ierr := checkDeviceBucket(device); ierr != nil {
+		c.JSON(ierr.Status, ierr.Body)
+		return
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a multipart/form-data body"})
+		return
+	}
+
+	var (
+		results  []*batchItemResult
+		uploaded []string
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+	)
+	// Acquired before an image is read, so at most BatchConcurrency images
+	// are held in memory at once
+	slots := make(chan struct{}, cfg.Ingest.BatchConcurrency)
+
+	finish := func(status int, streamErr string) {
+		wg.Wait()
+		audit.SetTargets(c, uploaded...)
+
+		created := 0
+		for _, r := range results {
+			if r.Status == http.StatusCreated {
+				created++
+			}
+		}
+		body := gin.H{"results": results, "created": created, "failed": len(results) - created}
+		if streamErr != "" {
+			body["error"] = streamErr
+		}
+		c.JSON(status, body)
+	}
+
+	fields := map[string]string{}
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			finish(http.StatusBadRequest, "Failed to read multipart body: "+err.Error())
+			return
+		}
+
+		name := part.FormName()
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxBatchFieldSize+1))
+			part.Close()
+			if err != nil || len(value) > maxBatchFieldSize {
+				finish(http.StatusBadRequest, fmt.Sprintf("Failed to read field %q", name))
+				return
+			}
+			fields[name] = string(value)
+			continue
+		}
+		if name != "image" {
+			part.Close()
+			finish(http.StatusBadRequest, fmt.Sprintf("Unexpected file part %q, expected image", name))
+			return
+		}
+
+		if len(results) >= cfg.Ingest.BatchMaxItems {
+			part.Close()
+			finish(http.StatusRequestEntityTooLarge, fmt.Sprintf("A batch may contain at most %d items", cfg.Ingest.BatchMaxItems))
+			return
+		}
+
+		result := &batchItemResult{Index: len(results), Filename: part.FileName()}
+		results = append(results, result)
+
+		slots <- struct{}{}
+		image, err := io.ReadAll(io.LimitReader(part, maxBatchImageSize+1))
+		part.Close()
+		received := time.Now()
+		if err != nil {
+			<-slots
+			finish(http.StatusBadRequest, "Failed to read image: "+err.Error())
+			return
+		}
+
+		upload := snapshotUpload{
+			Filename:   part.FileName(),
+			Image:      bytes.NewReader(image),
+			Detection:  fields["detection"],
+			CapturedAt: fields["captured_at"],
+			SentAt:     fields["sent_at"],
+			Signature: payloadSignature{
+				Signature: fields["signature"],
+				Timestamp: fields["timestamp"],
+				Nonce:     fields["nonce"],
+			},
+		}
+		if upload.SentAt == "" {
+			upload.SentAt = upload.Signature.Timestamp
+		}
+		clientID, ierr := clientSnapshotID(fields["client_id"], "")
+		upload.ClientID = clientID
+		fields = map[string]string{}
+
+		if ierr != nil {
+			<-slots
+			result.Status = ierr.Status
+			result.Error = ierr.Error()
+			continue
+		}
+
+		if len(image) > maxBatchImageSize {
+			<-slots
+			result.Status = http.StatusRequestEntityTooLarge
+			result.Error = fmt.Sprintf("Image exceeds %d bytes", maxBatchImageSize)
+			continue
+		}
+
+		allowed, _, err := ratelimit.Allow(c.Request.Context(), "ingest:"+middleware.ByDevice(c), cfg.RateLimit.Ingest)
+		if err != nil {
+			log.Printf("rate limit ingest: %v", err)
+		} else if !allowed {
+			<-slots
+			result.Status = http.StatusTooManyRequests
+			result.Error = "Rate limit exceeded"
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("batch ingest item %d: panic: %v", result.Index, r)
+					result.Status = http.StatusInternalServerError
+					result.Error = "Internal error"
+				}
+			}()
+
+			snapshot, replayed, ierr := ingestSnapshot(device, apiKeyID, upload, received)
+			if snapshot.AuthenticatedURL != "" {
+				mu.Lock()
+				uploaded = append(uploaded, snapshot.AuthenticatedURL)
+				mu.Unlock()
+			}
+			if ierr != nil {
+				result.Status = ierr.Status
+				result.Error = ierr.Error()
+				result.Fields = ierr.Body["fields"]
+				return
+			}
+			result.Status = http.StatusCreated
+			result.Snapshot = &snapshot
+			result.Replayed = replayed
+		}()
+	}
+
+	if len(fields) > 0 {
+		finish(http.StatusBadRequest, "Fields after the last image part have no image")
+		return
+	}
+	if len(results) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Batch contains no images"})
+		return
+	}
+	finish(http.StatusOK, "")
+}
@@ -3,9 +3,9 @@ package handlers
 import (
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
 	"github.com/Mahamudul-Dev/aisense_portal_snapshot/gcs"
 	"github.com/Mahamudul-Dev/aisense_portal_snapshot/utils"
 	"github.com/gin-gonic/gin"
@@ -39,8 +39,9 @@ func RequestNewBucket(c *gin.Context) {
 	}
 
 	bucketName := userName + "_" + utils.GenerateUUID()
+	audit.SetTargets(c, bucketName)
 
-	if err := gcs.CreateBucket(os.Getenv("GCP_PROJECT_ID"), bucketName, "US"); err != nil {
+	if err := gcs.CreateBucket(cfg.ProjectID, bucketName, cfg.GCS.BucketLocation); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create bucket"})
 		return
 	}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// epochMillisThreshold separates epoch seconds from epoch milliseconds; in
+// seconds it is far in the future, in milliseconds it is 2001.
+const epochMillisThreshold = 1e12
+
+// maxEpochMillis is the end of year 9999, the latest time RFC 3339 can
+// express, in epoch milliseconds.
+const maxEpochMillis = 253402300799999
+
+// captureTime is when a frame was taken and how far the device clock is off.
+type captureTime struct {
+	CapturedAt time.Time
+	ReceivedAt time.Time
+	// ClockSkew is device time minus server time, when it can be measured
+	ClockSkew *time.Duration
+	Skewed    bool
+}
+
+// parseDeviceTime parses a device timestamp given in RFC 3339 or as Unix
+// epoch seconds or milliseconds, with an optional fraction.
+func parseDeviceTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	epoch, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(epoch) || epoch <= 0 || epoch > maxEpochMillis {
+		return time.Time{}, errors.New("expected RFC 3339 or Unix epoch seconds or milliseconds")
+	}
+	if epoch >= epochMillisThreshold {
+		return time.UnixMilli(int64(epoch)), nil
+	}
+	sec, frac := math.Modf(epoch)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// resolveCaptureTime interprets the optional captured_at and sent_at values
+// of an upload. Clock skew is measured from the device's send time, since a
+// late captured_at is normal for frames queued offline. Without a send time
+// only a captured_at in the future can be recognised as skew.
+func resolveCaptureTime(capturedAt, sentAt string, received time.Time) (captureTime, error) {
+	ct := captureTime{CapturedAt: received, ReceivedAt: received}
+
+	if capturedAt != "" {
+		t, err := parseDeviceTime(capturedAt)
+		if err != nil {
+			return ct, errors.New("invalid captured_at: " + err.Error())
+		}
+		ct.CapturedAt = t
+	}
+
+	if sentAt != "" {
+		t, err := parseDeviceTime(sentAt)
+		if err != nil {
+			return ct, errors.New("invalid sent_at: " + err.Error())
+		}
+		skew := t.Sub(received)
+		ct.ClockSkew = &skew
+	} else if ahead := ct.CapturedAt.Sub(received); ahead > cfg.Ingest.MaxClockSkew {
+		ct.ClockSkew = &ahead
+	}
+
+	if ct.ClockSkew != nil {
+		ct.Skewed = ct.ClockSkew.Abs() > cfg.Ingest.MaxClockSkew
+	}
+	return ct, nil
+}
+
+// clockSkewSeconds converts a measured skew for storage.
+func (ct captureTime) clockSkewSeconds() *float64 {
+	if ct.ClockSkew == nil {
+		return nil
+	}
+	seconds := ct.ClockSkew.Seconds()
+	return &seconds
+}
+
+// deviceTime is a JSON timestamp in any form parseDeviceTime accepts, as a
+// string or a bare epoch number.
+type deviceTime struct {
+	time.Time
+}
+
+func (t *deviceTime) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" || s == "" {
+		return nil
+	}
+	parsed, err := parseDeviceTime(s)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
+// ptr returns nil for an unset time, for nullable columns.
+func (t deviceTime) ptr() *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t.Time
+}
@@ -0,0 +1,433 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/detection"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// classDescendantSQL counts how often the second id appears in the subtree
+// rooted at the first, to keep the taxonomy free of cycles.
+const classDescendantSQL = `WITH RECURSIVE class_tree AS (
+		SELECT id FROM classes WHERE id = ?
+		UNION SELECT c.id FROM classes c JOIN class_tree t ON c.parent_id = t.id
+	) SELECT COUNT(*) FROM class_tree WHERE id = ?`
+
+// ListClasses lists all detection classes with their aliases.
+func ListClasses(c *gin.Context) {
+	var classes []models.Classes
+	if err := db.DB.Preload("Aliases").Order("name").Find(&classes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"classes": classes})
+}
+
+// GetClass returns a class with its aliases and direct children.
+func GetClass(c *gin.Context) {
+	class, ok := loadClass(c)
+	if !ok {
+		return
+	}
+
+	var children []models.Classes
+	if err := db.DB.Where("parent_id = ?", class.ID).Order("name").Find(&children).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"class": class, "children": children})
+}
+
+// CreateClass registers a class, optionally under a parent and with aliases.
+func CreateClass(c *gin.Context) {
+	var request struct {
+		Name        string   `json:"name" binding:"required"`
+		Description *string  `json:"description"`
+		ParentID    *int     `json:"parent_id"`
+		Aliases     []string `json:"aliases"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if !detection.ValidClassName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid class name"})
+		return
+	}
+	audit.SetTargets(c, "class:"+name)
+
+	class := models.Classes{Name: name, Description: request.Description, ParentID: request.ParentID}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("lower(name) = lower(?)", name).First(&models.Classes{}).Error; err == nil {
+			return errClassConflict
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if request.ParentID != nil {
+			if err := tx.First(&models.Classes{}, *request.ParentID).Error; err != nil {
+				return errParentNotFound(err)
+			}
+		}
+		if err := tx.Create(&class).Error; err != nil {
+			if isUniqueViolation(err) {
+				return errClassConflict
+			}
+			return err
+		}
+		for _, alias := range request.Aliases {
+			if err := createAlias(tx, class.ID, alias); err != nil {
+				return err
+			}
+		}
+		return tx.Preload("Aliases").First(&class, class.ID).Error
+	})
+	if err != nil {
+		respondClassError(c, err)
+		return
+	}
+	detection.InvalidateClassCache()
+
+	c.JSON(http.StatusCreated, gin.H{"class": class})
+}
+
+// UpdateClass renames a class or changes its description or parent. A
+// parent_id of 0 makes it a top-level class. A renamed class keeps its
+// previous name as an alias.
+func UpdateClass(c *gin.Context) {
+	class, ok := loadClass(c)
+	if !ok {
+		return
+	}
+	audit.SetTargets(c, "class:"+strconv.Itoa(class.ID))
+
+	var request struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		ParentID    *int    `json:"parent_id"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]any{}
+		if request.Name != nil {
+			name := strings.TrimSpace(*request.Name)
+			if !detection.ValidClassName(name) {
+				return errInvalidClassName
+			}
+			var existing models.Classes
+			if err := tx.Where("lower(name) = lower(?) AND id <> ?", name, class.ID).First(&existing).Error; err == nil {
+				return errClassConflict
+			} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			// Devices keep sending the old name, so it stays resolvable
+			if detection.NormalizeAlias(name) != detection.NormalizeAlias(class.Name) {
+				if err := keepNameAsAlias(tx, class.Name, class.ID); err != nil {
+					return err
+				}
+			}
+			updates["name"] = name
+		}
+		if request.Description != nil {
+			updates["description"] = *request.Description
+		}
+		if request.ParentID != nil {
+			if *request.ParentID == 0 {
+				updates["parent_id"] = nil
+			} else {
+				if err := tx.First(&models.Classes{}, *request.ParentID).Error; err != nil {
+					return errParentNotFound(err)
+				}
+				var cycle int64
+				if err := tx.Raw(classDescendantSQL, class.ID, *request.ParentID).Scan(&cycle).Error; err != nil {
+					return err
+				}
+				if cycle > 0 {
+					return errClassCycle
+				}
+				updates["parent_id"] = *request.ParentID
+			}
+		}
+		if len(updates) > 0 {
+			if err := tx.Model(&class).Updates(updates).Error; err != nil {
+				if isUniqueViolation(err) {
+					return errClassConflict
+				}
+				return err
+			}
+		}
+		return tx.Preload("Aliases").First(&class, class.ID).Error
+	})
+	if err != nil {
+		respondClassError(c, err)
+		return
+	}
+	detection.InvalidateClassCache()
+
+	c.JSON(http.StatusOK, gin.H{"class": class})
+}
+
+// DeleteClass removes a class that no stored detection refers to. Its
+// children become top-level classes and its aliases are removed.
+func DeleteClass(c *gin.Context) {
+	class, ok := loadClass(c)
+	if !ok {
+		return
+	}
+	audit.SetTargets(c, "class:"+strconv.Itoa(class.ID))
+
+	var used int64
+	if err := db.DB.Model(&models.DetectionObject{}).Where("class_id = ?", class.ID).Count(&used).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+	if used > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Class is used by stored detections; merge it into another class instead"})
+		return
+	}
+
+	if err := db.DB.Delete(&class).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete class: " + err.Error()})
+		return
+	}
+	detection.InvalidateClassCache()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Class deleted successfully"})
+}
+
+// MergeClass folds a class into another: its detections, aliases and
+// children move to the target, its name becomes an alias of the target and
+// the class is removed, all in one transaction.
+func MergeClass(c *gin.Context) {
+	class, ok := loadClass(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Into int `json:"into" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	audit.SetTargets(c, "class:"+strconv.Itoa(class.ID), "class:"+strconv.Itoa(request.Into))
+
+	var target models.Classes
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if request.Into == class.ID {
+			return errMergeSelf
+		}
+		if err := tx.First(&target, request.Into).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errNoMergeTarget
+			}
+			return err
+		}
+		// The class's children move to the target, so the target must not
+		// be one of them
+		var cycle int64
+		if err := tx.Raw(classDescendantSQL, class.ID, target.ID).Scan(&cycle).Error; err != nil {
+			return err
+		}
+		if cycle > 0 {
+			return errMergeCycle
+		}
+
+		if err := tx.Model(&models.DetectionObject{}).Where("class_id = ?", class.ID).Update("class_id", target.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.ClassAlias{}).Where("class_id = ?", class.ID).Update("class_id", target.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Classes{}).Where("parent_id = ?", class.ID).Update("parent_id", target.ID).Error; err != nil {
+			return err
+		}
+		if err := keepNameAsAlias(tx, class.Name, target.ID); err != nil {
+			return err
+		}
+		if err := tx.Delete(&class).Error; err != nil {
+			return err
+		}
+		return tx.Preload("Aliases").First(&target, target.ID).Error
+	})
+	if err != nil {
+		respondClassError(c, err)
+		return
+	}
+	detection.InvalidateClassCache()
+
+	c.JSON(http.StatusOK, gin.H{"class": target})
+}
+
+// CreateClassAlias adds an alias that ingest resolves to the class.
+func CreateClassAlias(c *gin.Context) {
+	class, ok := loadClass(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Alias string `json:"alias" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	audit.SetTargets(c, "class:"+strconv.Itoa(class.ID), "alias:"+detection.NormalizeAlias(request.Alias))
+
+	if err := db.DB.Transaction(func(tx *gorm.DB) error {
+		return createAlias(tx, class.ID, request.Alias)
+	}); err != nil {
+		respondClassError(c, err)
+		return
+	}
+	detection.InvalidateClassCache()
+
+	if err := db.DB.Preload("Aliases").First(&class, class.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"class": class})
+}
+
+// DeleteClassAlias removes one of a class's aliases.
+func DeleteClassAlias(c *gin.Context) {
+	classID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid class id"})
+		return
+	}
+	aliasID, err := strconv.Atoi(c.Param("aliasId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alias id"})
+		return
+	}
+
+	audit.SetTargets(c, "class:"+c.Param("id"), "alias:"+c.Param("aliasId"))
+
+	result := db.DB.Where("id = ? AND class_id = ?", aliasID, classID).Delete(&models.ClassAlias{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete alias: " + result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alias not found"})
+		return
+	}
+	detection.InvalidateClassCache()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alias deleted successfully"})
+}
+
+var (
+	errClassConflict    = errors.New("a class with this name already exists")
+	errAliasConflict    = errors.New("alias is already in use")
+	errInvalidClassName = errors.New("invalid class name")
+	errClassCycle       = errors.New("parent_id would make the class its own ancestor")
+	errNoParent         = errors.New("parent class not found")
+	errNoMergeTarget    = errors.New("class to merge into not found")
+	errMergeSelf        = errors.New("a class cannot be merged into itself")
+	errMergeCycle       = errors.New("a class cannot be merged into one of its descendants")
+)
+
+func errParentNotFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errNoParent
+	}
+	return err
+}
+
+// createAlias stores alias for classID, rejecting aliases already mapped to
+// any class.
+func createAlias(tx *gorm.DB, classID int, alias string) error {
+	alias = detection.NormalizeAlias(alias)
+	if !detection.ValidClassName(alias) {
+		return errInvalidClassName
+	}
+	if err := tx.Where("alias = ?", alias).First(&models.ClassAlias{}).Error; err == nil {
+		return errAliasConflict
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if err := tx.Create(&models.ClassAlias{Alias: alias, ClassID: classID}).Error; err != nil {
+		if isUniqueViolation(err) {
+			return errAliasConflict
+		}
+		return err
+	}
+	return nil
+}
+
+// keepNameAsAlias makes a class name that is going away an alias of
+// classID, unless it already is an alias of some class.
+func keepNameAsAlias(tx *gorm.DB, name string, classID int) error {
+	alias := detection.NormalizeAlias(name)
+	if err := tx.Where("alias = ?", alias).First(&models.ClassAlias{}).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return tx.Create(&models.ClassAlias{Alias: alias, ClassID: classID}).Error
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a unique index violation, which
+// the name and alias checks above can race into.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+func respondClassError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errClassConflict), errors.Is(err, errAliasConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errInvalidClassName), errors.Is(err, errClassCycle), errors.Is(err, errNoParent),
+		errors.Is(err, errNoMergeTarget), errors.Is(err, errMergeSelf), errors.Is(err, errMergeCycle):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+	}
+}
+
+// loadClass loads the class named by the :id parameter, writing the error
+// response if it cannot.
+func loadClass(c *gin.Context) (models.Classes, bool) {
+	var class models.Classes
+	classID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid class id"})
+		return class, false
+	}
+
+	if err := db.DB.Preload("Aliases").First(&class, classID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Class not found"})
+			return class, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return class, false
+	}
+	return class, true
+}
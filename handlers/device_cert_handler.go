@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RegisterDeviceCertificate maps a client certificate to a device, either by
+// the fingerprint of an uploaded PEM certificate or by subject alone.
+// Registering a revoked certificate again reactivates it; registering an
+// active one is a conflict.
+func RegisterDeviceCertificate(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+c.Param("id"))
+
+	var request struct {
+		Certificate string `json:"certificate"`
+		Subject     string `json:"subject"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	if (request.Certificate == "") == (request.Subject == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Provide exactly one of 'certificate' (PEM) or 'subject'"})
+		return
+	}
+
+	if err := db.DB.Select("id").First(&models.Device{}, deviceID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	registered := models.DeviceCertificate{DeviceID: deviceID}
+	if request.Certificate != "" {
+		cert, err := auth.ParseCertificatePEM([]byte(request.Certificate))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		fingerprint := auth.CertificateFingerprint(cert)
+		subject := cert.Subject.String()
+		registered.Fingerprint = &fingerprint
+		registered.Subject = &subject
+		registered.NotAfter = &cert.NotAfter
+	} else {
+		registered.Subject = &request.Subject
+	}
+
+	// A fingerprint can only be registered once: an active certificate is a
+	// conflict, a revoked one is reactivated for this device
+	if registered.Fingerprint != nil {
+		var existing models.DeviceCertificate
+		err := db.DB.Where("fingerprint = ?", *registered.Fingerprint).First(&existing).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+			return
+		}
+		if err == nil {
+			if existing.RevokedAt == nil {
+				c.JSON(http.StatusConflict, gin.H{"error": "Certificate is already registered", "certificate_id": existing.ID})
+				return
+			}
+			audit.SetTargets(c, "device:"+c.Param("id"), "certificate:"+strconv.Itoa(existing.ID))
+			updates := map[string]any{
+				"device_id":  deviceID,
+				"subject":    registered.Subject,
+				"not_after":  registered.NotAfter,
+				"revoked_at": nil,
+			}
+			if err := db.DB.Model(&existing).Updates(updates).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reactivate certificate: " + err.Error()})
+				return
+			}
+			existing.DeviceID = deviceID
+			existing.Subject = registered.Subject
+			existing.NotAfter = registered.NotAfter
+			existing.RevokedAt = nil
+			c.JSON(http.StatusOK, existing)
+			return
+		}
+	}
+
+	if err := db.DB.Create(&registered).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register certificate: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, registered)
+}
+
+// ListDeviceCertificates lists the client certificates mapped to a device.
+func ListDeviceCertificates(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+
+	var certificates []models.DeviceCertificate
+	if err := db.DB.Where("device_id = ?", deviceID).Order("created_at DESC").Find(&certificates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"certificates": certificates})
+}
+
+// RevokeDeviceCertificate stops a certificate from authenticating its device.
+func RevokeDeviceCertificate(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+	certID, err := strconv.Atoi(c.Param("certId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid certificate id"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+c.Param("id"), "certificate:"+c.Param("certId"))
+
+	result := db.DB.Model(&models.DeviceCertificate{}).
+		Where("id = ? AND device_id = ? AND revoked_at IS NULL", certID, deviceID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke certificate: " + result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Active certificate not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Certificate revoked successfully"})
+}
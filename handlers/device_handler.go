@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const deviceTokenTTL = 24 * time.Hour
+
+// IssueDeviceToken exchanges the device's credentials for a bearer token that
+// can be used on subsequent ingest requests. Only the device's password is
+// accepted, so a leaked token or API key cannot renew itself.
+func IssueDeviceToken(c *gin.Context) {
+	device, ok := middleware.CurrentDevice(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Device is not authenticated"})
+		return
+	}
+	if middleware.CurrentDeviceAuthMethod(c) != middleware.DeviceAuthPassword {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Device tokens are only issued for the device's user name and password"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+strconv.Itoa(device.ID))
+
+	token, err := auth.GenerateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	deviceToken := models.DeviceToken{
+		DeviceID:  device.ID,
+		TokenHash: auth.HashToken(token),
+		ExpiresAt: time.Now().Add(deviceTokenTTL),
+	}
+	if err := db.DB.Create(&deviceToken).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store token: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":      token,
+		"token_type": "Bearer",
+		"expires_at": deviceToken.ExpiresAt,
+	})
+}
+
+// SetDeviceTimezone sets the IANA time zone, e.g. "America/New_York", in
+// which a device's analytics are bucketed.
+func SetDeviceTimezone(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+c.Param("id"))
+
+	var request struct {
+		Timezone string `json:"timezone" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	if _, err := time.LoadLocation(request.Timezone); err != nil || request.Timezone == "Local" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown time zone"})
+		return
+	}
+
+	if err := db.DB.Select("id").First(&models.Device{}, deviceID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	timezone := models.DeviceTimezone{DeviceID: deviceID, Timezone: request.Timezone}
+	err = db.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"timezone", "updated_at"}),
+	}).Create(&timezone).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store time zone: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Time zone set successfully", "device_id": deviceID, "timezone": timezone.Timezone})
+}
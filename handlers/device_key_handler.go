@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxActiveAPIKeys allows one key to be rolled out while the old one is still
+// in use, so a fleet can be rotated without downtime.
+const maxActiveAPIKeys = 2
+
+const apiKeyPrefix = "ask_"
+
+// CreateDeviceAPIKey issues a new ingest API key for a device. The plaintext
+// key is only returned in this response.
+func CreateDeviceAPIKey(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+c.Param("id"))
+
+	var request struct {
+		Name      string     `json:"name"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	token, err := auth.GenerateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key"})
+		return
+	}
+	key := apiKeyPrefix + token
+
+	tx := db.DB.Begin()
+
+	// Lock the device row so concurrent requests cannot exceed the active key limit
+	var device models.Device
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&device, deviceID).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	var active int64
+	err = tx.Model(&models.DeviceAPIKey{}).
+		Where("device_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", deviceID, time.Now()).
+		Count(&active).Error
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+	if active >= maxActiveAPIKeys {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Device already has the maximum number of active API keys; revoke one first"})
+		return
+	}
+
+	apiKey := models.DeviceAPIKey{
+		DeviceID:  deviceID,
+		Name:      request.Name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		KeyHash:   auth.HashToken(key),
+		ExpiresAt: request.ExpiresAt,
+	}
+	if err := tx.Create(&apiKey).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key: " + err.Error()})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"api_key": apiKey,
+		"key":     key,
+		"note":    "Store this key now; it cannot be shown again",
+	})
+}
+
+// ListDeviceAPIKeys lists a device's API keys without their secrets.
+func ListDeviceAPIKeys(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+
+	var keys []models.DeviceAPIKey
+	if err := db.DB.Where("device_id = ?", deviceID).Order("created_at DESC").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// RevokeDeviceAPIKey revokes one of a device's API keys.
+func RevokeDeviceAPIKey(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+	keyID, err := strconv.Atoi(c.Param("keyId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key id"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+c.Param("id"), "api_key:"+c.Param("keyId"))
+
+	result := db.DB.Model(&models.DeviceAPIKey{}).
+		Where("id = ? AND device_id = ? AND revoked_at IS NULL", keyID, deviceID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key: " + result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Active API key not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked successfully"})
+}
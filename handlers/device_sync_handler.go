@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxSyncFrames bounds the frames listed in one handshake; a larger backlog
+// is reconciled page by page.
+const maxSyncFrames = 1000
+
+// Sync statuses recorded in DeviceSyncStatus.
+const (
+	syncStatusSynced  = "synced"
+	syncStatusPending = "pending"
+)
+
+// SyncDevice is the offline backlog handshake. The device reports how many
+// frames it has queued and their capture time range, and lists queued frames
+// by client_id. The response says which of those the server already holds
+// and which are missing, oldest first, so the device uploads only the
+// missing ones with the same client_id. Repeating the handshake after an
+// interruption resumes where the uploads stopped.
+func SyncDevice(c *gin.Context) {
+	device, ok := middleware.CurrentDevice(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Device is not authenticated"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+strconv.Itoa(device.ID))
+
+	var request struct {
+		QueuedCount      int        `json:"queued_count"`
+		OldestCapturedAt deviceTime `json:"oldest_captured_at"`
+		NewestCapturedAt deviceTime `json:"newest_captured_at"`
+		Frames           []struct {
+			ClientID   string     `json:"client_id" binding:"required"`
+			CapturedAt deviceTime `json:"captured_at"`
+		} `json:"frames" binding:"dive"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	if request.QueuedCount < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "queued_count must not be negative"})
+		return
+	}
+	if len(request.Frames) > maxSyncFrames {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d frames per handshake", maxSyncFrames)})
+		return
+	}
+
+	clientIDs := make([]string, len(request.Frames))
+	for i, frame := range request.Frames {
+		if !validClientID(frame.ClientID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("frames[%d].client_id must be a UUID", i)})
+			return
+		}
+		clientIDs[i] = frame.ClientID
+	}
+
+	var held []string
+	if len(clientIDs) > 0 {
+		err := db.DB.Model(&models.Snapshot{}).
+			Where("device_id = ? AND client_id IN ?", device.ID, clientIDs).
+			Pluck("client_id", &held).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+			return
+		}
+	}
+
+	isHeld := make(map[string]bool, len(held))
+	for _, id := range held {
+		isHeld[id] = true
+	}
+	missingFrames := request.Frames[:0:0]
+	for _, frame := range request.Frames {
+		if !isHeld[frame.ClientID] {
+			missingFrames = append(missingFrames, frame)
+			isHeld[frame.ClientID] = true // list repeated ids once
+		}
+	}
+	sort.SliceStable(missingFrames, func(i, j int) bool {
+		return missingFrames[i].CapturedAt.Before(missingFrames[j].CapturedAt.Time)
+	})
+	missing := make([]string, len(missingFrames))
+	for i, frame := range missingFrames {
+		missing[i] = frame.ClientID
+	}
+
+	status := models.DeviceSyncStatus{
+		DeviceID:        device.ID,
+		Status:          syncStatusSynced,
+		BacklogCount:    request.QueuedCount,
+		MissingCount:    len(missing),
+		OldestQueuedAt:  request.OldestCapturedAt.ptr(),
+		NewestQueuedAt:  request.NewestCapturedAt.ptr(),
+		LastHandshakeAt: time.Now(),
+	}
+	if len(missing) > 0 || request.QueuedCount > len(request.Frames) {
+		status.Status = syncStatusPending
+	}
+
+	err := db.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"status", "backlog_count", "missing_count", "oldest_queued_at", "newest_queued_at", "last_handshake_at"}),
+	}).Create(&status).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store sync status: " + err.Error()})
+		return
+	}
+
+	if held == nil {
+		held = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"held":    held,
+		"missing": missing,
+		"status":  status.Status,
+	})
+}
+
+// GetDeviceSyncStatus returns what a device last reported in the sync
+// handshake.
+func GetDeviceSyncStatus(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+
+	var status models.DeviceSyncStatus
+	if err := db.DB.Where("device_id = ?", deviceID).First(&status).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device has not synced"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sync_status": status})
+}
+
+// ListDeviceSyncStatuses lists the sync status of every device visible to the
+// user that has synced, largest reported backlog first.
+func ListDeviceSyncStatuses(c *gin.Context) {
+	claims, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+		return
+	}
+
+	var statuses []models.DeviceSyncStatus
+	if err := scopeDeviceRows(db.DB, claims, "device_id").Order("backlog_count DESC, device_id").Find(&statuses).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sync_statuses": statuses})
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/detection"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/export"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/gcs"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Export job statuses recorded in ExportJob.
+const (
+	exportStatusQueued  = "queued"
+	exportStatusRunning = "running"
+	exportStatusDone    = "done"
+	exportStatusFailed  = "failed"
+)
+
+// exportQuery builds the rows of an export from snapshot filters given as
+// query parameters. With a class filter an objects export only contains
+// objects of that class.
+func exportQuery(snapshots *gorm.DB, dataset export.Dataset, values url.Values) (*gorm.DB, error) {
+	snapshots, err := applySnapshotFilters(values, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	query := export.Query(snapshots, dataset)
+	if v := values.Get("class"); v != "" && dataset == export.DatasetObjects {
+		query = query.Where("d.class_id IN ("+detection.ClassTreeSQL+")", v, detection.NormalizeAlias(v))
+	}
+	return query, nil
+}
+
+// Export writes snapshots or detection objects matching the filters to w,
+// for the export command. It is not scoped to a user.
+func Export(w io.Writer, dataset export.Dataset, format export.Format, filters url.Values) (int, error) {
+	query, err := exportQuery(db.DB.Model(&models.Snapshot{}), dataset, filters)
+	if err != nil {
+		return 0, err
+	}
+	return export.Write(w, query, dataset, format)
+}
+
+// CreateExport exports the snapshots visible to the user, or their detected
+// objects (dataset=snapshots|objects), as format=csv|ndjson|parquet. It takes the
+// same filters as SearchSnapshots. Exports of at most EXPORT_MAX_STREAM_ROWS
+// rows are streamed in the response; larger ones, or any with async=true,
+// run as a background job that writes the file to the user's bucket (or
+// bucket=, which the user must own) and respond 202 with the job. Background
+// exports need a role that may write to buckets and are refused with 503
+// while EXPORT_QUEUE jobs are waiting.
+func CreateExport(c *gin.Context) {
+	claims, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+		return
+	}
+
+	dataset, err := export.ParseDataset(c.DefaultQuery("dataset", string(export.DatasetSnapshots)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	format, err := export.ParseFormat(c.DefaultQuery("format", string(export.FormatCSV)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filters := c.Request.URL.Query()
+	query, err := exportQuery(scopeSnapshots(db.DB.Model(&models.Snapshot{}), claims), dataset, filters)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	async := c.Query("async") == "true"
+	if !async {
+		var count int64
+		if err := query.Session(&gorm.Session{}).Count(&count).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+			return
+		}
+		async = count > int64(cfg.Export.MaxStreamRows)
+	}
+
+	if !async {
+		filename := export.FileName(dataset, format, time.Now())
+		c.Header("Content-Type", format.ContentType())
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		c.Status(http.StatusOK)
+		// The status is sent with the first rows, so a later failure can
+		// only cut the file short
+		if _, err := export.Write(c.Writer, query, dataset, format); err != nil {
+			log.Printf("export %s: %v", filename, err)
+		}
+		return
+	}
+
+	if !auth.HasPermission(claims.Role, auth.PermExportWrite) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to write exports to a bucket; narrow the filters to at most " +
+			strconv.Itoa(cfg.Export.MaxStreamRows) + " rows"})
+		return
+	}
+	bucket, err := exportBucket(claims, c.Query("bucket"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	job := models.ExportJob{
+		UserID:      claims.UserID,
+		Dataset:     string(dataset),
+		Format:      string(format),
+		Filters:     c.Request.URL.RawQuery,
+		Status:      exportStatusQueued,
+		Bucket:      bucket,
+		HeartbeatAt: &now,
+	}
+	if err := db.DB.Create(&job).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create export job: " + err.Error()})
+		return
+	}
+	audit.SetTargets(c, "export:"+strconv.Itoa(job.ID), "gs://"+bucket)
+
+	if !queueExportJob(job, query) {
+		updateExportJob(job.ID, map[string]any{"status": exportStatusFailed, "error": "export queue is full", "finished_at": time.Now()})
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many exports are waiting; try again later"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"export_job": job})
+}
+
+// exportBucket picks the bucket a background export is written to: the
+// requested one if the user may write to it, else the bucket of the user's
+// first device.
+func exportBucket(claims *auth.Claims, requested string) (string, error) {
+	if requested != "" {
+		if auth.ManagesAllDevices(claims.Role) {
+			return requested, nil
+		}
+		owned, err := ownedBuckets(claims.UserID, map[string]struct{}{requested: {}})
+		if err != nil {
+			return "", err
+		}
+		if !owned[requested] {
+			return "", errors.New("Not allowed to write to bucket " + requested)
+		}
+		return requested, nil
+	}
+
+	var device models.Device
+	err := db.DB.Where("device_user_id = ? AND bucket IS NOT NULL AND bucket <> ''", claims.UserID).
+		Order("id").First(&device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", errors.New("No bucket to write the export to; pass bucket")
+	}
+	if err != nil {
+		return "", fmt.Errorf("Database error: %w", err)
+	}
+	return *device.Bucket, nil
+}
+
+// runExportJob writes the export file to the job's bucket and records the
+// outcome on the job.
+func runExportJob(job models.ExportJob, query *gorm.DB) {
+	object := "exports/" + strconv.Itoa(job.ID) + "-" + export.FileName(export.Dataset(job.Dataset), export.Format(job.Format), job.CreatedAt)
+
+	reader, writer := io.Pipe()
+	written := make(chan int, 1)
+	go func() {
+		n, err := export.Write(writer, query, export.Dataset(job.Dataset), export.Format(job.Format))
+		written <- n
+		writer.CloseWithError(err)
+	}()
+
+	uri, err := gcs.UploadFileAndGetGCSUriReader(job.Bucket, object, reader)
+	// Unblocks the writer if the upload stopped reading early
+	reader.CloseWithError(err)
+	rows := <-written
+
+	now := time.Now()
+	updates := map[string]any{"rows": rows, "finished_at": now, "status": exportStatusDone, "object_uri": uri}
+	if err != nil {
+		log.Printf("export job %d: %v", job.ID, err)
+		updates["status"] = exportStatusFailed
+		updates["object_uri"] = nil
+		updates["error"] = err.Error()
+	}
+	updateExportJob(job.ID, updates)
+}
+
+// ListExportJobs lists the user's export jobs, newest first.
+func ListExportJobs(c *gin.Context) {
+	claims, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+		return
+	}
+
+	var jobs []models.ExportJob
+	if err := db.DB.Where("user_id = ?", claims.UserID).Order("id DESC").Limit(maxPageSize).Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"export_jobs": jobs})
+}
+
+// GetExportJob returns one of the user's export jobs and, once it is done,
+// a signed URL to download the file.
+func GetExportJob(c *gin.Context) {
+	claims, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid export job id"})
+		return
+	}
+
+	var job models.ExportJob
+	if err := db.DB.Where("id = ? AND user_id = ?", id, claims.UserID).First(&job).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Export job not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	response := gin.H{"export_job": job}
+	if job.Status == exportStatusDone && job.ObjectURI != nil {
+		signedURL, err := gcs.GenerateSignedURL(*job.ObjectURI, signedURLExpiry)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate signed URL", "details": err.Error()})
+			return
+		}
+		response["signed_url"] = signedURL
+
+		audit.SetTargets(c, "export:"+strconv.Itoa(job.ID), *job.ObjectURI)
+		audit.Record(c, audit.ActionSign)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"gorm.io/gorm"
+)
+
+// exportHeartbeat is how often the jobs an instance holds are marked alive.
+// Queued or running jobs not marked for three heartbeats belong to an
+// instance that stopped and are failed.
+const exportHeartbeat = time.Minute
+
+type exportRun struct {
+	job   models.ExportJob
+	query *gorm.DB
+}
+
+var (
+	exportRuns chan exportRun
+
+	// exportsHeld are the ids of the jobs queued or running on this
+	// instance.
+	exportsHeld   = map[int]struct{}{}
+	exportsHeldMu sync.Mutex
+)
+
+// StartExportJobs starts the workers that run background exports, so only a
+// bounded number run at once, and fails the jobs left behind by instances
+// that stopped, now and on every heartbeat.
+func StartExportJobs() {
+	exportRuns = make(chan exportRun, cfg.Export.Queue)
+	for i := 0; i < cfg.Export.Workers; i++ {
+		go func() {
+			for run := range exportRuns {
+				updateExportJob(run.job.ID, map[string]any{"status": exportStatusRunning})
+				runExportJob(run.job, run.query)
+				exportsHeldMu.Lock()
+				delete(exportsHeld, run.job.ID)
+				exportsHeldMu.Unlock()
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(exportHeartbeat)
+		defer ticker.Stop()
+		for {
+			failStaleExportJobs()
+			<-ticker.C
+			heartbeatExportJobs()
+		}
+	}()
+}
+
+// queueExportJob hands a created job to the export workers without waiting.
+// It reports false when the queue is full.
+func queueExportJob(job models.ExportJob, query *gorm.DB) bool {
+	exportsHeldMu.Lock()
+	defer exportsHeldMu.Unlock()
+	select {
+	case exportRuns <- exportRun{job, query}:
+		exportsHeld[job.ID] = struct{}{}
+		return true
+	default:
+		return false
+	}
+}
+
+func heartbeatExportJobs() {
+	exportsHeldMu.Lock()
+	ids := make([]int, 0, len(exportsHeld))
+	for id := range exportsHeld {
+		ids = append(ids, id)
+	}
+	exportsHeldMu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	err := db.DB.Model(&models.ExportJob{}).Where("id IN ?", ids).Update("heartbeat_at", time.Now()).Error
+	if err != nil {
+		log.Printf("export jobs: failed to record heartbeat: %v", err)
+	}
+}
+
+// failStaleExportJobs fails queued or running jobs whose instance stopped
+// before finishing them.
+func failStaleExportJobs() {
+	now := time.Now()
+	result := db.DB.Model(&models.ExportJob{}).
+		Where("status IN ? AND COALESCE(heartbeat_at, created_at) < ?",
+			[]string{exportStatusQueued, exportStatusRunning}, now.Add(-3*exportHeartbeat)).
+		Updates(map[string]any{"status": exportStatusFailed, "error": "interrupted by a restart", "finished_at": now})
+	if result.Error != nil {
+		log.Printf("export jobs: failed to fail stale jobs: %v", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("export jobs: failed %d interrupted jobs", result.RowsAffected)
+	}
+}
+
+func updateExportJob(id int, updates map[string]any) {
+	if err := db.DB.Model(&models.ExportJob{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		log.Printf("export job %d: failed to record status: %v", id, err)
+	}
+}
@@ -0,0 +1,12 @@
+package handlers
+
+import "github.com/Mahamudul-Dev/aisense_portal_snapshot/config"
+
+var cfg *config.Config
+
+// Init gives the handlers the service configuration. It must be called
+// before the router starts serving.
+func Init(c *config.Config) {
+	cfg = c
+	startThumbnailWorkers(c.Ingest.ThumbnailWorkers, c.Ingest.ThumbnailQueue)
+}
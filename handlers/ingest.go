@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/alert"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/detection"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/gcs"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// snapshotUpload is one image and its metadata, posted on its own to
+// CreateSnapshot or as an item of CreateSnapshotBatch.
+type snapshotUpload struct {
+	Filename   string
+	Image      io.ReadSeeker
+	Detection  string
+	CapturedAt string
+	SentAt     string
+	Signature  payloadSignature
+	// ClientID makes the upload idempotent per device; see clientSnapshotID
+	ClientID string
+}
+
+// ingestError is a rejected upload with the status and body to respond with.
+type ingestError struct {
+	Status int
+	Body   gin.H
+}
+
+func (e *ingestError) Error() string {
+	msg, _ := e.Body["error"].(string)
+	return msg
+}
+
+func ingestFailed(status int, msg string) *ingestError {
+	return &ingestError{Status: status, Body: gin.H{"error": msg}}
+}
+
+// validClientID reports whether id is a valid client id. Uploads, batch
+// items and the sync handshake all identify frames by the same UUIDs.
+func validClientID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+// clientSnapshotID validates the device's id for an upload, given as a
+// client_id and/or an Idempotency-Key header, both UUIDs. Either may be
+// empty.
+func clientSnapshotID(clientID, idempotencyKey string) (string, *ingestError) {
+	if clientID != "" && !validClientID(clientID) {
+		return "", ingestFailed(http.StatusBadRequest, "client_id must be a UUID")
+	}
+	if idempotencyKey != "" && !validClientID(idempotencyKey) {
+		return "", ingestFailed(http.StatusBadRequest, "Idempotency-Key must be a UUID")
+	}
+	if clientID != "" && idempotencyKey != "" && clientID != idempotencyKey {
+		return "", ingestFailed(http.StatusBadRequest, "client_id and Idempotency-Key differ")
+	}
+	if clientID != "" {
+		return clientID, nil
+	}
+	return idempotencyKey, nil
+}
+
+// findClientSnapshot loads the device's snapshot with the given client id.
+func findClientSnapshot(deviceID int, clientID string) (models.Snapshot, bool, *ingestError) {
+	var snapshot models.Snapshot
+	err := db.DB.Where("device_id = ? AND client_id = ?", deviceID, clientID).First(&snapshot).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return snapshot, false, nil
+	}
+	if err != nil {
+		return snapshot, false, ingestFailed(http.StatusInternalServerError, "Database error: "+err.Error())
+	}
+	return snapshot, true, nil
+}
+
+// checkDeviceBucket checks that the device has a bucket to upload into.
+func checkDeviceBucket(device models.Device) *ingestError {
+	if device.Bucket == nil {
+		return ingestFailed(http.StatusBadRequest, "Device bucket is not set")
+	}
+
+	exists, err := gcs.BucketExists(*device.Bucket)
+	if err != nil {
+		return ingestFailed(http.StatusInternalServerError, "Failed to check bucket existence")
+	}
+	if !exists {
+		return ingestFailed(http.StatusInternalServerError, "Bucket does not exist")
+	}
+	return nil
+}
+
+// ingestSnapshot validates, uploads and stores one snapshot for a device
+// whose bucket was checked with checkDeviceBucket. When the image was
+// uploaded the returned snapshot carries its URL even if storing it failed,
+// so the caller can audit it. If the device already stored a snapshot with
+// the upload's client id, that snapshot is returned with replayed set and
+// nothing is uploaded or inserted.
+func ingestSnapshot(device models.Device, apiKeyID *int, upload snapshotUpload, received time.Time) (models.Snapshot, bool, *ingestError) {
+	// A retry of an upload that succeeded gets the original result. This
+	// runs before the signature check, whose nonce a retry reuses.
+	if upload.ClientID != "" {
+		if existing, ok, ierr := findClientSnapshot(device.ID, upload.ClientID); ierr != nil || ok {
+			return existing, ok, ierr
+		}
+	}
+
+	// Parse and validate detection JSON
+	detectionData, err := detection.Parse([]byte(upload.Detection))
+	if err != nil {
+		var verr *detection.ValidationError
+		if errors.As(err, &verr) {
+			return models.Snapshot{}, false, &ingestError{Status: http.StatusBadRequest, Body: gin.H{"error": "Invalid detection", "fields": verr.Fields}}
+		}
+		return models.Snapshot{}, false, ingestFailed(http.StatusBadRequest, "Invalid detection JSON")
+	}
+
+	captured, err := resolveCaptureTime(upload.CapturedAt, upload.SentAt, received)
+	if err != nil {
+		return models.Snapshot{}, false, ingestFailed(http.StatusBadRequest, err.Error())
+	}
+
+	// Verify the device's payload signature before touching storage
+	nonce, ierr := verifySignedPayload(device.ID, upload.Image, upload.Detection, upload.Signature)
+	if ierr != nil {
+		return models.Snapshot{}, false, ierr
+	}
+
+	// Upload file directly from the stream
+	imageURL, err := gcs.UploadFileAndGetGCSUriReader(*device.Bucket, upload.Filename, upload.Image)
+	if err != nil {
+		return models.Snapshot{}, false, ingestFailed(http.StatusInternalServerError, "Failed to upload image")
+	}
+
+	snapshot := models.Snapshot{
+		DeviceID:         device.ID,
+		Name:             upload.Filename,
+		RpiNo:            device.Name,
+		ImagePath:        "/" + *device.Bucket + "/" + upload.Filename,
+		AuthenticatedURL: imageURL,
+		FileAvailable:    true,
+		APIKeyID:         apiKeyID,
+		CapturedAt:       captured.CapturedAt,
+		ReceivedAt:       captured.ReceivedAt,
+		ClockSkewSeconds: captured.clockSkewSeconds(),
+		ClockSkewed:      captured.Skewed,
+	}
+	if upload.ClientID != "" {
+		snapshot.ClientID = &upload.ClientID
+	}
+
+	// Resolve aliases so the stored detection uses canonical class names
+	classIDs, err := detection.ResolveClasses(db.DB, detectionData)
+	if err != nil {
+		return snapshot, false, ingestFailed(http.StatusInternalServerError, err.Error())
+	}
+	snapshot.DistanceCM = snapshotDistance(detectionData)
+
+	// Store the canonical, versioned form of the detection
+	snapshot.Detection, err = json.Marshal(detectionData)
+	if err != nil {
+		return snapshot, false, ingestFailed(http.StatusInternalServerError, "Failed to marshal detection")
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		// The nonce is only spent once the snapshot is stored
+		if ierr := recordNonce(tx, nonce); ierr != nil {
+			return ierr
+		}
+		if err := tx.Create(&snapshot).Error; err != nil {
+			return ingestFailed(http.StatusInternalServerError, "Failed to create snapshot: "+err.Error())
+		}
+		// Save one row per detected object
+		if err := detection.Store(tx, snapshot.ID, detectionData, classIDs); err != nil {
+			return ingestFailed(http.StatusInternalServerError, err.Error())
+		}
+		if err := alert.Enqueue(tx, snapshot); err != nil {
+			return ingestFailed(http.StatusInternalServerError, err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		// A concurrent upload with the same client id won the insert
+		if upload.ClientID != "" {
+			if existing, ok, _ := findClientSnapshot(device.ID, upload.ClientID); ok {
+				return existing, true, nil
+			}
+		}
+		var ierr *ingestError
+		if errors.As(err, &ierr) {
+			return snapshot, false, ierr
+		}
+		return snapshot, false, ingestFailed(http.StatusInternalServerError, "Failed to commit transaction")
+	}
+
+	// Alerts and thumbnails are best effort and must not delay the device
+	alert.Notify()
+
+	if _, err := upload.Image.Seek(0, io.SeekStart); err == nil {
+		if data, err := io.ReadAll(upload.Image); err == nil {
+			queueThumbnails(snapshot.ID, *device.Bucket, upload.Filename, data)
+		}
+	}
+
+	return snapshot, false, nil
+}
+
+// snapshotDistance computes the configured distance metric, or NULL if the
+// snapshot has no object the metric considers.
+func snapshotDistance(det *detection.Detection) decimal.NullDecimal {
+	distance, ok := det.Distance(cfg.Distance.Metric, cfg.Distance.Classes)
+	return decimal.NullDecimal{Decimal: decimal.NewFromFloat(distance), Valid: ok}
+}
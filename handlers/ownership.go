@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/gcs"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// authorizeURIs resolves every gs:// URI to its bucket, the Device using that
+// bucket and the Device's owning User, and rejects the request unless the
+// authenticated user owns all of them or manages all devices. It writes the error
+// response itself and reports whether the handler may continue.
+func authorizeURIs(c *gin.Context, uris []string) bool {
+	claims, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+		return false
+	}
+
+	buckets := make(map[string]struct{}, len(uris))
+	for _, uri := range uris {
+		bucket, _, err := gcs.ParseGCSURI(uri)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false
+		}
+		buckets[bucket] = struct{}{}
+	}
+
+	if auth.ManagesAllDevices(claims.Role) {
+		return true
+	}
+
+	owned, err := ownedBuckets(claims.UserID, buckets)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve object owners: " + err.Error()})
+		return false
+	}
+
+	var denied []string
+	for _, uri := range uris {
+		bucket, _, _ := gcs.ParseGCSURI(uri)
+		if !owned[bucket] {
+			denied = append(denied, uri)
+		}
+	}
+	if len(denied) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to access these objects", "uris": denied})
+		return false
+	}
+
+	return true
+}
+
+// ownedBuckets reports which of the given buckets are used only by devices
+// owned by userID.
+func ownedBuckets(userID int, buckets map[string]struct{}) (map[string]bool, error) {
+	names := make([]string, 0, len(buckets))
+	for name := range buckets {
+		names = append(names, name)
+	}
+
+	var devices []models.Device
+	err := db.DB.Select("id", "bucket", "device_user_id").
+		Where("bucket IN ?", names).
+		Find(&devices).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load devices: %w", err)
+	}
+
+	// A bucket shared with another user's device is not considered owned
+	owned := make(map[string]bool, len(names))
+	for _, device := range devices {
+		bucket := *device.Bucket
+		isOwner := device.DeviceUserID != nil && *device.DeviceUserID == userID
+		if prev, seen := owned[bucket]; seen {
+			owned[bucket] = prev && isOwner
+		} else {
+			owned[bucket] = isOwner
+		}
+	}
+	return owned, nil
+}
+
+// scopeSnapshots restricts a snapshots query to the user's own devices unless
+// the user manages all devices.
+func scopeSnapshots(query *gorm.DB, claims *auth.Claims) *gorm.DB {
+	return scopeDeviceRows(query, claims, "snapshots.device_id")
+}
+
+// scopeDeviceRows restricts a query whose column holds a device id to the
+// user's own devices unless the user manages all devices.
+func scopeDeviceRows(query *gorm.DB, claims *auth.Claims, column string) *gorm.DB {
+	if auth.ManagesAllDevices(claims.Role) {
+		return query
+	}
+	owned := db.DB.Model(&models.Device{}).Select("id").Where("device_user_id = ?", claims.UserID)
+	return query.Where(column+" IN (?)", owned)
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// payloadSignature is what a device sends to sign one upload: the X-Signature,
+// X-Timestamp and X-Nonce headers, or the matching fields of a batch item.
+type payloadSignature struct {
+	Signature string
+	Timestamp string
+	Nonce     string
+}
+
+func signatureHeaders(c *gin.Context) payloadSignature {
+	return payloadSignature{
+		Signature: c.GetHeader("X-Signature"),
+		Timestamp: c.GetHeader("X-Timestamp"),
+		Nonce:     c.GetHeader("X-Nonce"),
+	}
+}
+
+// verifySignedPayload checks the Ed25519 signature over the image hash,
+// detection JSON, device ID and timestamp, and rejects stale timestamps and
+// reused nonces. Devices without a registered signing key are let through
+// unless signed payloads are required by configuration. The image is rewound
+// afterwards. The nonce of a verified payload is returned for recordNonce to
+// store with the snapshot, so a failed upload can be retried with it.
+func verifySignedPayload(deviceID int, image io.ReadSeeker, detection string, sig payloadSignature) (*models.DeviceNonce, *ingestError) {
+	var signingKey models.DeviceSigningKey
+	if err := db.DB.Where("device_id = ?", deviceID).First(&signingKey).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ingestFailed(http.StatusInternalServerError, "Database error: "+err.Error())
+		}
+		if cfg.Signing.RequireSignedPayloads {
+			return nil, ingestFailed(http.StatusUnauthorized, "Device has no signing key registered")
+		}
+		return nil, nil
+	}
+
+	if sig.Signature == "" || sig.Timestamp == "" || sig.Nonce == "" {
+		return nil, ingestFailed(http.StatusUnauthorized, "X-Signature, X-Timestamp and X-Nonce headers are required")
+	}
+
+	unix, err := strconv.ParseInt(sig.Timestamp, 10, 64)
+	if err != nil {
+		return nil, ingestFailed(http.StatusBadRequest, "Invalid X-Timestamp")
+	}
+	maxAge := cfg.Signing.MaxAge
+	if age := time.Since(time.Unix(unix, 0)); age > maxAge || age < -maxAge {
+		return nil, ingestFailed(http.StatusUnauthorized, "Signed payload is stale")
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, image); err != nil {
+		return nil, ingestFailed(http.StatusBadRequest, "Failed to read image")
+	}
+	if _, err := image.Seek(0, io.SeekStart); err != nil {
+		return nil, ingestFailed(http.StatusInternalServerError, "Failed to rewind image")
+	}
+
+	message := auth.PayloadMessage(hex.EncodeToString(hash.Sum(nil)), detection, deviceID, sig.Timestamp, sig.Nonce)
+	if err := auth.VerifyPayload(signingKey.PublicKey, sig.Signature, message); err != nil {
+		return nil, ingestFailed(http.StatusUnauthorized, "Invalid payload signature")
+	}
+
+	// A stored nonce means this exact request was already accepted
+	var used int64
+	if err := db.DB.Model(&models.DeviceNonce{}).Where("device_id = ? AND nonce = ?", deviceID, sig.Nonce).Count(&used).Error; err != nil {
+		return nil, ingestFailed(http.StatusInternalServerError, "Database error: "+err.Error())
+	}
+	if used > 0 {
+		return nil, ingestFailed(http.StatusConflict, "Nonce has already been used")
+	}
+
+	// Nonces older than the accepted window can no longer be replayed
+	db.DB.Where("device_id = ? AND created_at < ?", deviceID, time.Now().Add(-2*maxAge)).Delete(&models.DeviceNonce{})
+
+	return &models.DeviceNonce{DeviceID: deviceID, Nonce: sig.Nonce}, nil
+}
+
+// recordNonce stores a verified payload's nonce in the transaction that
+// stores its snapshot. A conflict means a concurrent request with the same
+// nonce won.
+func recordNonce(tx *gorm.DB, nonce *models.DeviceNonce) *ingestError {
+	if nonce == nil {
+		return nil
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(nonce)
+	if result.Error != nil {
+		return ingestFailed(http.StatusInternalServerError, "Failed to record nonce: "+result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return ingestFailed(http.StatusConflict, "Nonce has already been used")
+	}
+	return nil
+}
+
+// SetDeviceSigningKey registers or replaces a device's Ed25519 public key.
+func SetDeviceSigningKey(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+c.Param("id"))
+
+	var request struct {
+		PublicKey string `json:"public_key" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	if _, err := auth.ParsePublicKey(request.PublicKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := db.DB.Select("id").First(&models.Device{}, deviceID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	signingKey := models.DeviceSigningKey{DeviceID: deviceID, PublicKey: request.PublicKey}
+	err = db.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"public_key", "created_at"}),
+	}).Create(&signingKey).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store signing key: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Signing key stored successfully", "device_id": deviceID})
+}
+
+// DeleteDeviceSigningKey removes a device's signing key, so its payloads are
+// no longer verified.
+func DeleteDeviceSigningKey(c *gin.Context) {
+	deviceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return
+	}
+
+	audit.SetTargets(c, "device:"+c.Param("id"))
+
+	result := db.DB.Where("device_id = ?", deviceID).Delete(&models.DeviceSigningKey{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete signing key: " + result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Signing key not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Signing key deleted successfully"})
+}
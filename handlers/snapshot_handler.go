@@ -1,21 +1,19 @@
 package handlers
 
 import (
-	"encoding/json"
-	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
-	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
 	"github.com/Mahamudul-Dev/aisense_portal_snapshot/gcs"
-	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
 	"github.com/gin-gonic/gin"
-	"github.com/shopspring/decimal"
-	"gorm.io/gorm"
 )
 
 func CreateSnapshot(c *gin.Context) {
+	received := time.Now()
+
 	// Parse form
 	if err := c.Request.ParseMultipartForm(10 << 20); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse form"})
@@ -30,126 +28,71 @@ func CreateSnapshot(c *gin.Context) {
 	}
 	defer file.Close()
 
-	// Parse device ID
-	deviceID, err := strconv.Atoi(c.PostForm("device_id"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device_id"})
+	// Device was authenticated by middleware.DeviceAuth
+	device, ok := middleware.CurrentDevice(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Device is not authenticated"})
 		return
 	}
 
-	// Parse detection JSON
-	detectionRaw := c.PostForm("detection")
-	var detectionData struct {
-		Objects map[string]any `json:"objects"`
-	}
-	if err := json.Unmarshal([]byte(detectionRaw), &detectionData); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid detection JSON"})
-		return
-	}
+	// A client certificate identifies the device on its own, so the posted
+	// device_id and device_name are ignored in that mode
+	trustedIdentity := middleware.CurrentDeviceAuthMethod(c) == middleware.DeviceAuthCertificate
 
-	// Load device with user
-	var device models.Device
-	if err := db.DB.Preload("User").First(&device, deviceID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
-		return
+	// A posted device_id must match the authenticated device
+	if postedID := c.PostForm("device_id"); postedID != "" && !trustedIdentity {
+		id, err := strconv.Atoi(postedID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device_id"})
+			return
+		}
+		if id != device.ID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "device_id does not match authenticated device"})
+			return
+		}
 	}
 
 	// Validate device name
-	if c.PostForm("device_name") != device.Name {
+	if name := c.PostForm("device_name"); name != "" && name != device.Name && !trustedIdentity {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Device name does not match"})
 		return
 	}
 
-	if device.Bucket == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Device bucket is not set"})
+	if ierr := checkDeviceBucket(device); ierr != nil {
+		c.JSON(ierr.Status, ierr.Body)
 		return
 	}
 
-	// Check bucket existence
-	exists, err := gcs.BucketExists(*device.Bucket)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check bucket existence"})
-		return
-	}
-	if !exists {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Bucket does not exist"})
+	clientID, ierr := clientSnapshotID(c.PostForm("client_id"), c.GetHeader("Idempotency-Key"))
+	if ierr != nil {
+		c.JSON(ierr.Status, ierr.Body)
 		return
 	}
 
-	// Upload file directly from the multipart file stream
-	imageURL, err := gcs.UploadFileAndGetGCSUriReader(*device.Bucket, fileHeader.Filename, file)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload image"})
-		return
-	}
-
-	// Start DB transaction
-	tx := db.DB.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Transaction failed"})
-		}
-	}()
-
-	// Validate detection objects
-	objects := detectionData.Objects
-	if objects == nil {
-		tx.Rollback()
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing 'objects' key in detection payload"})
-		return
-	}
-
-	// Save detection classes
-	for className := range objects {
-		var existingClass models.Classes
-		err := tx.Where("name = ?", className).First(&existingClass).Error
-		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				newClass := models.Classes{Name: className}
-				if err := tx.Create(&newClass).Error; err != nil {
-					tx.Rollback()
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create class: " + err.Error()})
-					return
-				}
-			} else {
-				tx.Rollback()
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
-				return
-			}
-		}
-	}
-
-	// Marshal detection JSON to store in DB
-	detectionJSON, err := json.Marshal(detectionData)
-	if err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to marshal detection"})
-		return
+	// The signed X-Timestamp doubles as the send time for clock skew
+	sentAt := c.PostForm("sent_at")
+	if sentAt == "" {
+		sentAt = c.GetHeader("X-Timestamp")
 	}
 
-	// Create snapshot record
-	snapshot := models.Snapshot{
-		DeviceID:         deviceID,
-		Name:             fileHeader.Filename,
-		RpiNo:            device.Name,
-		DistanceCM:       decimal.NewFromFloat(0.0),
-		ImagePath:        "/" + *device.Bucket + "/" + fileHeader.Filename,
-		AuthenticatedURL: imageURL,
-		Detection:        detectionJSON,
-		FileAvailable:    true,
+	snapshot, replayed, ierr := ingestSnapshot(device, middleware.CurrentDeviceAPIKeyID(c), snapshotUpload{
+		Filename:   fileHeader.Filename,
+		Image:      file,
+		Detection:  c.PostForm("detection"),
+		CapturedAt: c.PostForm("captured_at"),
+		SentAt:     sentAt,
+		Signature:  signatureHeaders(c),
+		ClientID:   clientID,
+	}, received)
+	if snapshot.AuthenticatedURL != "" {
+		audit.SetTargets(c, snapshot.AuthenticatedURL)
 	}
-
-	if err := tx.Create(&snapshot).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create snapshot: " + err.Error()})
+	if ierr != nil {
+		c.JSON(ierr.Status, ierr.Body)
 		return
 	}
-
-	// Commit transaction
-	if err := tx.Commit().Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
-		return
+	if replayed {
+		c.Header("Idempotent-Replayed", "true")
 	}
 
 	c.JSON(http.StatusCreated, snapshot)
@@ -323,6 +266,11 @@ func AuthorizeSnapshot(c *gin.Context) {
 		return
 	}
 
+	audit.SetTargets(c, gsURI)
+	if !authorizeURIs(c, []string{gsURI}) {
+		return
+	}
+
 	signedURL, err := gcs.GenerateSignedURL(gsURI, 30*time.Minute)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate signed URL", "details": err.Error()})
@@ -349,6 +297,11 @@ func AuthorizeBulkSnapshots(c *gin.Context) {
 		return
 	}
 
+	audit.SetTargets(c, request.URIs...)
+	if !authorizeURIs(c, request.URIs) {
+		return
+	}
+
 	signedURLs, err := gcs.GenerateBulkSignedURLs(request.URIs, 30*time.Minute)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate signed URLs", "details": err.Error()})
@@ -371,6 +324,11 @@ func DeleteObject(c *gin.Context) {
 		return
 	}
 
+	audit.SetTargets(c, request.GCSUri)
+	if !authorizeURIs(c, []string{request.GCSUri}) {
+		return
+	}
+
 	// Delete the object
 	if err := gcs.DeleteObjectByURI(request.GCSUri); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete object: " + err.Error()})
@@ -391,6 +349,16 @@ func DeleteBulkObjects(c *gin.Context) {
 		return
 	}
 
+	if len(request.GCSUris) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No URIs provided"})
+		return
+	}
+
+	audit.SetTargets(c, request.GCSUris...)
+	if !authorizeURIs(c, request.GCSUris) {
+		return
+	}
+
 	// Delete the objects
 	if err := gcs.DeleteBulkObjects(request.GCSUris); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete objects: " + err.Error()})
@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/detection"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/gcs"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/thumbnail"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const signedURLExpiry = 30 * time.Minute
+
+// objectCountSQL counts the detected objects in a snapshot's detection JSON:
+// the length of every class array under "objects".
+const objectCountSQL = `(SELECT COALESCE(SUM(CASE WHEN jsonb_typeof(o.value) = 'array' THEN jsonb_array_length(o.value) ELSE 1 END), 0)
+	FROM jsonb_each(CASE WHEN jsonb_typeof(snapshots.detection->'objects') = 'object' THEN snapshots.detection->'objects' ELSE '{}'::jsonb END) o)`
+
+// snapshotCursor marks the last row of a page. CapturedAt is only set when
+// sorting by captured_at; ID breaks ties.
+type snapshotCursor struct {
+	CapturedAt *time.Time `json:"c,omitempty"`
+	ID         int        `json:"i"`
+}
+
+type snapshotResult struct {
+	models.Snapshot
+	SignedURL string `json:"signed_url,omitempty"`
+}
+
+// SearchSnapshots lists snapshots visible to the user, filtered by device_id,
+// user_id, from/to (captured_at, RFC 3339), class (also matching its aliases
+// and child classes), min_objects, min_distance/max_distance (distance_cm)
+// and file_available, sorted by captured_at or id and paginated with an
+// opaque cursor. With sign=true each result carries a fresh signed URL.
+func SearchSnapshots(c *gin.Context) {
+	claims, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+		return
+	}
+
+	query := scopeSnapshots(db.DB.Model(&models.Snapshot{}), claims)
+
+	query, err := applySnapshotFilters(c.Request.URL.Query(), query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sortBy := c.DefaultQuery("sort", "captured_at")
+	if sortBy != "captured_at" && sortBy != "id" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be captured_at or id"})
+		return
+	}
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return
+	}
+
+	limit := defaultPageSize
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxPageSize)})
+			return
+		}
+		limit = n
+	}
+
+	sign := c.Query("sign") == "true"
+	if sign && !auth.HasPermission(claims.Role, auth.PermSnapshotSign) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied", "permission": auth.PermSnapshotSign})
+		return
+	}
+
+	cmp := "<"
+	if order == "asc" {
+		cmp = ">"
+	}
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := decodeSnapshotCursor(v)
+		if err != nil || (sortBy == "captured_at") != (cursor.CapturedAt != nil) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		if sortBy == "captured_at" {
+			query = query.Where("(snapshots.captured_at, snapshots.id) "+cmp+" (?, ?)", *cursor.CapturedAt, cursor.ID)
+		} else {
+			query = query.Where("snapshots.id "+cmp+" ?", cursor.ID)
+		}
+	}
+
+	if sortBy == "captured_at" {
+		query = query.Order("snapshots.captured_at " + order).Order("snapshots.id " + order)
+	} else {
+		query = query.Order("snapshots.id " + order)
+	}
+
+	// Fetch one extra row to know whether there is a next page
+	var snapshots []models.Snapshot
+	if err := query.Limit(limit + 1).Find(&snapshots).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	var nextCursor string
+	if len(snapshots) > limit {
+		snapshots = snapshots[:limit]
+		last := snapshots[len(snapshots)-1]
+		cursor := snapshotCursor{ID: last.ID}
+		if sortBy == "captured_at" {
+			cursor.CapturedAt = &last.CapturedAt
+		}
+		nextCursor = encodeSnapshotCursor(cursor)
+	}
+
+	results := make([]snapshotResult, len(snapshots))
+	var signed []string
+	for i, snapshot := range snapshots {
+		results[i] = snapshotResult{Snapshot: snapshot}
+		if sign && snapshot.FileAvailable {
+			signedURL, err := gcs.GenerateSignedURL(snapshot.AuthenticatedURL, signedURLExpiry)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate signed URL", "details": err.Error()})
+				return
+			}
+			results[i].SignedURL = signedURL
+			signed = append(signed, snapshot.AuthenticatedURL)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"snapshots":   results,
+		"next_cursor": nextCursor,
+	})
+
+	if len(signed) > 0 {
+		audit.SetTargets(c, signed...)
+		audit.Record(c, audit.ActionBulkSign)
+	}
+}
+
+// applySnapshotFilters adds the filters shared by snapshot queries, given as
+// query parameters. The error describes the first invalid filter.
+func applySnapshotFilters(values url.Values, query *gorm.DB) (*gorm.DB, error) {
+	if v := values.Get("device_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.New("Invalid device_id")
+		}
+		query = query.Where("snapshots.device_id = ?", id)
+	}
+	if v := values.Get("user_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.New("Invalid user_id")
+		}
+		userDevices := db.DB.Model(&models.Device{}).Select("id").Where("device_user_id = ?", id)
+		query = query.Where("snapshots.device_id IN (?)", userDevices)
+	}
+	if v := values.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.New("Invalid 'from' time, expected RFC 3339")
+		}
+		query = query.Where("snapshots.captured_at >= ?", t)
+	}
+	if v := values.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.New("Invalid 'to' time, expected RFC 3339")
+		}
+		query = query.Where("snapshots.captured_at < ?", t)
+	}
+	if v := values.Get("class"); v != "" {
+		// The class, or an alias of it, and all of its child classes
+		query = query.Where("EXISTS (SELECT 1 FROM detection_objects d WHERE d.snapshot_id = snapshots.id AND d.class_id IN ("+detection.ClassTreeSQL+"))", v, detection.NormalizeAlias(v))
+	}
+	if v := values.Get("min_objects"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errors.New("Invalid min_objects")
+		}
+		query = query.Where(objectCountSQL+" >= ?", n)
+	}
+	if v := values.Get("min_distance"); v != "" {
+		d, err := strconv.ParseFloat(v, 64)
+		if err != nil || d < 0 {
+			return nil, errors.New("Invalid min_distance")
+		}
+		query = query.Where("snapshots.distance_cm >= ?", d)
+	}
+	if v := values.Get("max_distance"); v != "" {
+		d, err := strconv.ParseFloat(v, 64)
+		if err != nil || d < 0 {
+			return nil, errors.New("Invalid max_distance")
+		}
+		query = query.Where("snapshots.distance_cm <= ?", d)
+	}
+	if v := values.Get("file_available"); v != "" {
+		available, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("Invalid file_available")
+		}
+		query = query.Where("snapshots.file_available = ?", available)
+	}
+	return query, nil
+}
+
+func encodeSnapshotCursor(cursor snapshotCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSnapshotCursor(v string) (snapshotCursor, error) {
+	var cursor snapshotCursor
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
+
+// GetSnapshot returns one snapshot with its device, parsed detection data and
+// freshly signed image and thumbnail URLs. The weak ETag covers the stored
+// data only, so a matching If-None-Match gets 304 even though signed URLs
+// change on every request.
+func GetSnapshot(c *gin.Context) {
+	claims, ok := middleware.CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid snapshot id"})
+		return
+	}
+
+	// Snapshots outside the user's devices look the same as missing ones
+	var snapshot models.Snapshot
+	if err := scopeSnapshots(db.DB.Model(&models.Snapshot{}), claims).Where("snapshots.id = ?", id).First(&snapshot).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Snapshot not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	var device models.Device
+	if err := db.DB.First(&device, snapshot.DeviceID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+		return
+	}
+
+	etag := snapshotETag(snapshot, device)
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	var detection any
+	if len(snapshot.Detection) > 0 {
+		if err := json.Unmarshal(snapshot.Detection, &detection); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Stored detection is not valid JSON"})
+			return
+		}
+	}
+
+	response := gin.H{
+		"snapshot":  snapshot,
+		"device":    device,
+		"detection": detection,
+	}
+
+	if snapshot.FileAvailable && auth.HasPermission(claims.Role, auth.PermSnapshotSign) {
+		signedURL, err := gcs.GenerateSignedURL(snapshot.AuthenticatedURL, signedURLExpiry)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate signed URL", "details": err.Error()})
+			return
+		}
+		response["signed_url"] = signedURL
+		signed := []string{snapshot.AuthenticatedURL}
+
+		thumbnailURLs := gin.H{}
+		if snapshot.ThumbnailsAvailable {
+			bucket, object, err := gcs.ParseGCSURI(snapshot.AuthenticatedURL)
+			if err == nil {
+				for _, width := range thumbnail.Widths {
+					uri := "gs://" + bucket + "/" + thumbnail.ObjectName(object, width)
+					if url, err := gcs.GenerateSignedURL(uri, signedURLExpiry); err == nil {
+						thumbnailURLs[strconv.Itoa(width)] = url
+						signed = append(signed, uri)
+					}
+				}
+			}
+		}
+		response["thumbnail_urls"] = thumbnailURLs
+
+		audit.SetTargets(c, signed...)
+		audit.Record(c, audit.ActionSign)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// snapshotETag is a weak validator over the stored snapshot and device fields
+// shown in the detail view.
+func snapshotETag(snapshot models.Snapshot, device models.Device) string {
+	data, _ := json.Marshal(struct {
+		Snapshot     models.Snapshot
+		DeviceName   string
+		DeviceBucket *string
+		DeviceMod    time.Time
+	}{snapshot, device.Name, device.Bucket, device.LastModified})
+	sum := sha256.Sum256(data)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches implements weak comparison for an If-None-Match header.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
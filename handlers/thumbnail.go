@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/gcs"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/thumbnail"
+)
+
+type thumbnailJob struct {
+	snapshotID int
+	bucket     string
+	objectName string
+	data       []byte
+}
+
+var thumbnailJobs chan thumbnailJob
+
+// startThumbnailWorkers starts the workers that generate thumbnails, so only
+// a bounded number of images is decoded at once.
+func startThumbnailWorkers(workers, queue int) {
+	thumbnailJobs = make(chan thumbnailJob, queue)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range thumbnailJobs {
+				storeThumbnails(job.snapshotID, job.bucket, job.objectName, job.data)
+			}
+		}()
+	}
+}
+
+// queueThumbnails hands a snapshot's image to the thumbnail workers without
+// waiting. When the queue is full the snapshot gets no thumbnails.
+func queueThumbnails(snapshotID int, bucket, objectName string, data []byte) {
+	select {
+	case thumbnailJobs <- thumbnailJob{snapshotID, bucket, objectName, data}:
+	default:
+		log.Printf("thumbnails for snapshot %d: queue is full, skipped", snapshotID)
+	}
+}
+
+// storeThumbnails generates and uploads the snapshot's thumbnails and marks
+// them available. Failures are logged; the detail view then omits thumbnails.
+func storeThumbnails(snapshotID int, bucket, objectName string, data []byte) {
+	thumbnails, err := thumbnail.Generate(data)
+	if err != nil {
+		log.Printf("thumbnails for snapshot %d: %v", snapshotID, err)
+		return
+	}
+
+	for width, thumb := range thumbnails {
+		name := thumbnail.ObjectName(objectName, width)
+		if _, err := gcs.UploadFileAndGetGCSUriReader(bucket, name, bytes.NewReader(thumb)); err != nil {
+			log.Printf("thumbnails for snapshot %d: width %d: %v", snapshotID, width, err)
+			return
+		}
+	}
+
+	err = db.DB.Model(&models.Snapshot{}).Where("id = ?", snapshotID).Update("thumbnails_available", true).Error
+	if err != nil {
+		log.Printf("thumbnails for snapshot %d: %v", snapshotID, err)
+	}
+}
@@ -1,35 +1,160 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"slices"
+	"strings"
 
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/alert"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/audit"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/config"
 	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/gcs"
 	"github.com/Mahamudul-Dev/aisense_portal_snapshot/handlers"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/middleware"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/ratelimit"
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
 )
 
 func main() {
-	err := godotenv.Load()
+	// An optional leading command name runs a maintenance task instead of
+	// the server; flags follow it as usual, and the command's own flags
+	// follow "--"
+	command, args := "", os.Args[1:]
+	var commandArgs []string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+		if i := slices.Index(args, "--"); i >= 0 {
+			args, commandArgs = args[:i], args[i+1:]
+		}
+	}
 
+	cfg, err := config.Load(args)
 	if err != nil {
-		log.Fatalf("❌ Error loading .env file: %v", err)
+		log.Fatalf("❌ Error loading configuration: %v", err)
+	}
+
+	if cfg.GinMode != "" {
+		gin.SetMode(cfg.GinMode)
+	}
+
+	db.Init(cfg.DB)
+	db.Migrate()
+	if err := gcs.Init(cfg.GCS); err != nil {
+		log.Fatalf("❌ Error initialising GCS: %v", err)
+	}
+	auth.Init(cfg.Auth)
+	alert.Init(cfg.Alert)
+	handlers.Init(cfg)
+
+	if command != "" {
+		if err := runCommand(command, cfg, commandArgs); err != nil {
+			log.Fatalf("❌ %s: %v", command, err)
+		}
+		return
+	}
+
+	alert.Start()
+	handlers.StartExportJobs()
+
+	// Token buckets live in memory unless limits must hold across instances
+	if cfg.RateLimit.Store == "postgres" {
+		ratelimit.SetStore(ratelimit.NewPostgresStore(db.DB))
 	}
-	db.Init()
 
 	router := gin.Default()
-	port := os.Getenv("PORT")
+	port := cfg.Port
+
+	// Client IPs key the rate limits and the audit log, so forwarded IP
+	// headers are only believed from the configured proxies or platform
+	switch cfg.TrustedPlatform {
+	case "appengine":
+		router.TrustedPlatform = gin.PlatformGoogleAppEngine
+	case "cloudflare":
+		router.TrustedPlatform = gin.PlatformCloudflare
+	}
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("❌ Error setting trusted proxies: %v", err)
+	}
+
+	deviceAuth := middleware.DeviceAuth(cfg.TLS.MTLSEnabled())
+	ingestLimit := middleware.RateLimit("ingest", cfg.RateLimit.Ingest, middleware.ByDevice)
+	// Runs before deviceAuth so failed password checks are limited too
+	deviceAuthLimit := middleware.RateLimit("device-auth", cfg.RateLimit.DeviceAuth, middleware.ByIP)
+	loginLimit := middleware.RateLimit("login", cfg.RateLimit.Login, middleware.ByIP)
+	signLimit := middleware.RateLimit("sign", cfg.RateLimit.Sign, middleware.ByUserOrIP)
+	deleteLimit := middleware.RateLimit("delete", cfg.RateLimit.Delete, middleware.ByUserOrIP)
+	// Non-admins may only manage their own devices
+	deviceOwner := middleware.RequireDeviceOwner("id")
 
 	api := router.Group("/api")
 	{
-		api.POST("/snapshots", handlers.CreateSnapshot)
-		api.GET("/bucket/:name", handlers.RequestNewBucket)
-		api.GET("/snapshots", handlers.AuthorizeSnapshot)
-		api.POST("/snapshots/bulk", handlers.AuthorizeBulkSnapshots)
-		api.DELETE("/bulk-objects", handlers.DeleteBulkObjects)
-		api.DELETE("/objects", handlers.DeleteObject)
+		api.POST("/snapshots", audit.Log(audit.ActionSnapshotCreate), deviceAuthLimit, deviceAuth, ingestLimit, handlers.CreateSnapshot)
+		api.POST("/snapshots/batch", audit.Log(audit.ActionSnapshotBatchCreate), deviceAuthLimit, deviceAuth, handlers.CreateSnapshotBatch)
+		api.POST("/devices/sync", audit.Log(audit.ActionDeviceSync), deviceAuthLimit, deviceAuth, handlers.SyncDevice)
+		api.POST("/devices/token", audit.Log(audit.ActionDeviceTokenIssue), deviceAuthLimit, deviceAuth, handlers.IssueDeviceToken)
+		api.POST("/auth/login", audit.Log(audit.ActionLogin), loginLimit, handlers.Login)
+		api.POST("/auth/refresh", audit.Log(audit.ActionRefresh), handlers.RefreshToken)
+		api.POST("/auth/password/reset", audit.Log(audit.ActionPasswordReset), loginLimit, handlers.ResetPassword)
+
+		portal := api.Group("", middleware.UserAuth())
+		{
+			portal.POST("/auth/logout", audit.Log(audit.ActionLogout), handlers.Logout)
+			portal.POST("/auth/password", audit.Log(audit.ActionPasswordChange), loginLimit, handlers.ChangePassword)
+			portal.GET("/bucket/:name", audit.Log(audit.ActionBucketCreate), middleware.RequirePermission(auth.PermBucketManage), handlers.RequestNewBucket)
+			portal.GET("/snapshots", audit.Log(audit.ActionSign), middleware.RequirePermission(auth.PermSnapshotSign), signLimit, handlers.AuthorizeSnapshot)
+			portal.GET("/snapshots/search", middleware.RequirePermission(auth.PermSnapshotRead), signLimit, handlers.SearchSnapshots)
+			portal.GET("/snapshots/:id", middleware.RequirePermission(auth.PermSnapshotRead), signLimit, handlers.GetSnapshot)
+			portal.GET("/analytics/detections", middleware.RequirePermission(auth.PermSnapshotRead), handlers.DetectionAnalytics)
+			portal.POST("/exports", audit.Log(audit.ActionExportCreate), middleware.RequirePermission(auth.PermSnapshotRead), handlers.CreateExport)
+			portal.GET("/exports", middleware.RequirePermission(auth.PermSnapshotRead), handlers.ListExportJobs)
+			portal.GET("/exports/:id", middleware.RequirePermission(auth.PermSnapshotRead), signLimit, handlers.GetExportJob)
+			portal.GET("/classes", middleware.RequirePermission(auth.PermSnapshotRead), handlers.ListClasses)
+			portal.GET("/classes/:id", middleware.RequirePermission(auth.PermSnapshotRead), handlers.GetClass)
+			portal.POST("/snapshots/bulk", audit.Log(audit.ActionBulkSign), middleware.RequirePermission(auth.PermSnapshotSign), signLimit, handlers.AuthorizeBulkSnapshots)
+			portal.DELETE("/bulk-objects", audit.Log(audit.ActionBulkDelete), middleware.RequirePermission(auth.PermSnapshotDelete), deleteLimit, handlers.DeleteBulkObjects)
+			portal.DELETE("/objects", audit.Log(audit.ActionDelete), middleware.RequirePermission(auth.PermSnapshotDelete), deleteLimit, handlers.DeleteObject)
 
+			admin := portal.Group("/admin")
+			{
+				admin.PUT("/users/:id/role", audit.Log(audit.ActionUserRoleUpdate), middleware.RequirePermission(auth.PermUserManage), handlers.UpdateUserRole)
+				admin.POST("/users/:id/password-reset", audit.Log(audit.ActionPasswordResetIssue), middleware.RequirePermission(auth.PermUserManage), handlers.IssuePasswordReset)
+				admin.GET("/devices/sync", middleware.RequirePermission(auth.PermDeviceManage), handlers.ListDeviceSyncStatuses)
+				admin.GET("/devices/:id/sync", middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.GetDeviceSyncStatus)
+				admin.PUT("/devices/:id/timezone", audit.Log(audit.ActionDeviceTimezoneSet), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.SetDeviceTimezone)
+				admin.POST("/devices/:id/alert-rules", audit.Log(audit.ActionAlertRuleCreate), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.CreateAlertRule)
+				admin.GET("/devices/:id/alert-rules", middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.ListAlertRules)
+				admin.PUT("/devices/:id/alert-rules/:ruleId", audit.Log(audit.ActionAlertRuleUpdate), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.UpdateAlertRule)
+				admin.DELETE("/devices/:id/alert-rules/:ruleId", audit.Log(audit.ActionAlertRuleDelete), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.DeleteAlertRule)
+				admin.POST("/devices/:id/webhooks", audit.Log(audit.ActionAlertWebhookCreate), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.CreateAlertWebhook)
+				admin.GET("/devices/:id/webhooks", middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.ListAlertWebhooks)
+				admin.DELETE("/devices/:id/webhooks/:webhookId", audit.Log(audit.ActionAlertWebhookDelete), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.DeleteAlertWebhook)
+				admin.GET("/alert-deliveries", middleware.RequirePermission(auth.PermDeviceManage), handlers.ListAlertDeliveries)
+				admin.POST("/alert-deliveries/:id/redeliver", audit.Log(audit.ActionAlertRedeliver), middleware.RequirePermission(auth.PermDeviceManage), handlers.RedeliverAlert)
+				admin.PUT("/devices/:id/password", audit.Log(audit.ActionDevicePasswordSet), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.SetDevicePassword)
+				admin.POST("/devices/:id/api-keys", audit.Log(audit.ActionDeviceAPIKeyCreate), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.CreateDeviceAPIKey)
+				admin.GET("/devices/:id/api-keys", middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.ListDeviceAPIKeys)
+				admin.DELETE("/devices/:id/api-keys/:keyId", audit.Log(audit.ActionDeviceAPIKeyRevoke), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.RevokeDeviceAPIKey)
+				admin.POST("/devices/:id/certificates", audit.Log(audit.ActionDeviceCertRegister), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.RegisterDeviceCertificate)
+				admin.GET("/devices/:id/certificates", middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.ListDeviceCertificates)
+				admin.DELETE("/devices/:id/certificates/:certId", audit.Log(audit.ActionDeviceCertRevoke), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.RevokeDeviceCertificate)
+				admin.PUT("/devices/:id/signing-key", audit.Log(audit.ActionDeviceSigningKeySet), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.SetDeviceSigningKey)
+				admin.DELETE("/devices/:id/signing-key", audit.Log(audit.ActionDeviceSigningKeyDel), middleware.RequirePermission(auth.PermDeviceManage), deviceOwner, handlers.DeleteDeviceSigningKey)
+				admin.POST("/classes", audit.Log(audit.ActionClassCreate), middleware.RequirePermission(auth.PermClassManage), handlers.CreateClass)
+				admin.PUT("/classes/:id", audit.Log(audit.ActionClassUpdate), middleware.RequirePermission(auth.PermClassManage), handlers.UpdateClass)
+				admin.DELETE("/classes/:id", audit.Log(audit.ActionClassDelete), middleware.RequirePermission(auth.PermClassManage), handlers.DeleteClass)
+				admin.POST("/classes/:id/merge", audit.Log(audit.ActionClassMerge), middleware.RequirePermission(auth.PermClassManage), handlers.MergeClass)
+				admin.POST("/classes/:id/aliases", audit.Log(audit.ActionClassAliasCreate), middleware.RequirePermission(auth.PermClassManage), handlers.CreateClassAlias)
+				admin.DELETE("/classes/:id/aliases/:aliasId", audit.Log(audit.ActionClassAliasDelete), middleware.RequirePermission(auth.PermClassManage), handlers.DeleteClassAlias)
+				admin.GET("/audit-events", middleware.RequirePermission(auth.PermUserManage), handlers.ListAuditEvents)
+			}
+		}
 	}
 
 	router.GET("/", func(c *gin.Context) {
@@ -43,14 +168,73 @@ func main() {
 				"create snapshot": gin.H{
 					"method": "POST",
 					"path":   "/api/snapshots",
-					"body": gin.H{"image": "file", "device_id": "int", "captured_at": "time", "file_available": "bool", "device_name": "string",
+					"body": gin.H{"image": "file", "device_id": "int", "captured_at": "RFC 3339 or epoch s/ms (optional)", "sent_at": "RFC 3339 or epoch s/ms (optional, for clock skew)", "client_id": "UUID (optional, or as Idempotency-Key header; retries return the original snapshot)", "file_available": "bool", "device_name": "string",
 						"detection": map[string]string{}},
-					"type": "multipart/form-data",
+					"type":      "multipart/form-data",
+					"auth":      "X-API-Key, Basic device user_name:password or Bearer device token",
+					"signature": "X-Signature (base64 Ed25519 over sha256(image) hex, detection, device_id, X-Timestamp and X-Nonce joined by newlines), X-Timestamp (unix seconds), X-Nonce",
 				},
+				"create snapshot batch": gin.H{
+					"method": "POST",
+					"path":   "/api/snapshots/batch",
+					"type":   "multipart/form-data, streamed",
+					"body":   "per item: detection, captured_at, sent_at, client_id, signature, timestamp, nonce fields, then the image file part",
+					"auth":   "as create snapshot",
+					"note":   "Returns a result per item; each item counts against the ingest rate limit",
+				},
+				"device sync": gin.H{
+					"method": "POST",
+					"path":   "/api/devices/sync",
+					"body":   gin.H{"queued_count": "int", "oldest_captured_at": "time", "newest_captured_at": "time", "frames": "[{client_id (UUID), captured_at}] (max 1000)"},
+					"auth":   "as create snapshot",
+					"note":   "Returns held and missing client_ids, missing oldest first; upload missing frames with the same client_id and repeat to resume",
+				},
+				"issue device token": gin.H{
+					"method": "POST",
+					"path":   "/api/devices/token",
+					"auth":   "Basic device user_name:password",
+				},
+				"portal auth": "All routes below except login and refresh require Authorization: Bearer <access_token>",
 				"authorize snapshot": gin.H{
 					"method": "GET",
 					"path":   "/api/snapshots?uri=gs://bucket/object",
 				},
+				"search snapshots": gin.H{
+					"method": "GET",
+					"path":   "/api/snapshots/search?device_id=&user_id=&from=&to=&class=&min_objects=&min_distance=&max_distance=&file_available=&sort=captured_at|id&order=asc|desc&limit=&cursor=&sign=true",
+				},
+				"get snapshot": gin.H{
+					"method": "GET",
+					"path":   "/api/snapshots/:id",
+					"note":   "Returns the snapshot with device, detection, signed_url and thumbnail_urls; supports If-None-Match",
+				},
+				"detection analytics": gin.H{
+					"method": "GET",
+					"path":   "/api/analytics/detections?bucket=minute|hour|day|week&from=&to=&device_id=&class=&tz=",
+					"note":   "Counts, average and maximum objects per frame by device, class and bucket, in the device's time zone (PUT /api/admin/devices/:id/timezone {timezone})",
+				},
+				"alerts": gin.H{
+					"rules":      "POST|GET /api/admin/devices/:id/alert-rules {class, max_distance_cm, min_count, cooldown_seconds, enabled}, PUT|DELETE /api/admin/devices/:id/alert-rules/:ruleId",
+					"webhooks":   "POST|GET /api/admin/devices/:id/webhooks {url} (public hosts only), DELETE /api/admin/devices/:id/webhooks/:webhookId",
+					"deliveries": "GET /api/admin/alert-deliveries?device_id=&rule_id=&status=, POST /api/admin/alert-deliveries/:id/redeliver",
+					"note":       "Rules are evaluated on every new snapshot; alerts are posted to the device's webhooks signed with X-Alert-Signature and retried with backoff, also across restarts",
+				},
+				"exports": gin.H{
+					"create": "POST /api/exports?dataset=snapshots|objects&format=csv|ndjson|parquet&async=&bucket= plus the snapshot search filters",
+					"list":   "GET /api/exports",
+					"get":    "GET /api/exports/:id",
+					"note":   "Small exports are streamed; large ones (or async=true) return 202 with a job that writes to the user's bucket, and GET /api/exports/:id has a signed_url once it is done",
+				},
+				"classes": gin.H{
+					"list":   "GET /api/classes",
+					"get":    "GET /api/classes/:id",
+					"create": "POST /api/admin/classes {name, description, parent_id, aliases}",
+					"update": "PUT /api/admin/classes/:id {name, description, parent_id (0 clears)}",
+					"delete": "DELETE /api/admin/classes/:id",
+					"merge":  "POST /api/admin/classes/:id/merge {into}",
+					"alias":  "POST /api/admin/classes/:id/aliases {alias}, DELETE /api/admin/classes/:id/aliases/:aliasId",
+					"note":   "Ingest resolves aliases and names differing only in case to the canonical class; the search class filter includes child classes",
+				},
 				"authorize bulk snapshots": gin.H{
 					"method": "POST",
 					"path":   "/api/snapshots/bulk",
@@ -71,9 +255,108 @@ func main() {
 					"path":   "/api/bucket/:name",
 					"note":   "Replace :name with user name",
 				},
+				"login": gin.H{
+					"method": "POST",
+					"path":   "/api/auth/login",
+					"body":   gin.H{"email": "string", "password": "string"},
+				},
+				"refresh token": gin.H{
+					"method": "POST",
+					"path":   "/api/auth/refresh",
+					"body":   gin.H{"refresh_token": "string"},
+				},
+				"change user role": gin.H{
+					"method": "PUT",
+					"path":   "/api/admin/users/:id/role",
+					"body":   gin.H{"role": "admin | operator | customer | viewer"},
+				},
+				"device api keys": gin.H{
+					"create": "POST /api/admin/devices/:id/api-keys",
+					"list":   "GET /api/admin/devices/:id/api-keys",
+					"revoke": "DELETE /api/admin/devices/:id/api-keys/:keyId",
+					"body":   gin.H{"name": "string", "expires_at": "time (optional)"},
+				},
+				"device certificates": gin.H{
+					"register": "POST /api/admin/devices/:id/certificates",
+					"list":     "GET /api/admin/devices/:id/certificates",
+					"revoke":   "DELETE /api/admin/devices/:id/certificates/:certId",
+					"body":     gin.H{"certificate": "PEM string", "subject": "string (instead of certificate)"},
+				},
+				"device signing key": gin.H{
+					"set":    "PUT /api/admin/devices/:id/signing-key",
+					"delete": "DELETE /api/admin/devices/:id/signing-key",
+					"body":   gin.H{"public_key": "base64 Ed25519 public key"},
+				},
+				"audit events": gin.H{
+					"method": "GET",
+					"path":   "/api/admin/audit-events?actor_type=&actor_id=&action=&result=&target=&from=&to=&page=&page_size=",
+				},
+				"change password": gin.H{
+					"method": "POST",
+					"path":   "/api/auth/password",
+					"body":   gin.H{"current_password": "string", "new_password": "string"},
+				},
+				"issue password reset": gin.H{
+					"method": "POST",
+					"path":   "/api/admin/users/:id/password-reset",
+				},
+				"reset password": gin.H{
+					"method": "POST",
+					"path":   "/api/auth/password/reset",
+					"body":   gin.H{"token": "string", "new_password": "string"},
+				},
+				"set device password": gin.H{
+					"method": "PUT",
+					"path":   "/api/admin/devices/:id/password",
+					"body":   gin.H{"password": "string"},
+				},
+				"logout": gin.H{
+					"method": "POST",
+					"path":   "/api/auth/logout",
+					"body":   gin.H{"refresh_token": "string (optional)"},
+				},
 			},
 		})
 	})
 
+	// Terminate TLS ourselves when a certificate is configured; adding a client
+	// CA turns on mTLS device authentication
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := newTLSConfig(cfg.TLS.ClientCAFile)
+		if err != nil {
+			log.Fatalf("❌ Error configuring TLS: %v", err)
+		}
+		server := &http.Server{
+			Addr:      ":" + port,
+			Handler:   router,
+			TLSConfig: tlsConfig,
+		}
+		log.Fatal(server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile))
+	}
+
 	router.Run(":" + port)
 }
+
+// newTLSConfig returns the server TLS configuration. With a client CA file,
+// client certificates signed by that CA are verified when presented; device
+// routes then require one (see middleware.DeviceAuth) while portal users can
+// still connect without.
+func newTLSConfig(clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
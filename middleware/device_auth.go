@@ -0,0 +1,246 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	deviceContextKey           = "device"
+	deviceAPIKeyContextKey     = "device_api_key_id"
+	deviceAuthMethodContextKey = "device_auth_method"
+)
+
+// Device authentication methods recorded on the context by DeviceAuth.
+const (
+	DeviceAuthAPIKey      = "api_key"
+	DeviceAuthPassword    = "password"
+	DeviceAuthToken       = "token"
+	DeviceAuthCertificate = "certificate"
+)
+
+// DeviceAuth authenticates an ingest request with an admin-issued API key in
+// the X-API-Key header, the device's UserName/Password over HTTP Basic auth,
+// or a device token issued by IssueDeviceToken sent as a Bearer token. The
+// authenticated device (with its User preloaded) is stored on the context for
+// the handler.
+//
+// In mTLS mode (the service terminates TLS and verifies client certificates)
+// a registered client certificate is required instead and the other methods
+// are not accepted.
+func DeviceAuth(mtls bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var device models.Device
+		var method string
+		var ok bool
+
+		if mtls {
+			if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Client certificate is required"})
+				return
+			}
+			device, ok = deviceFromCertificate(c.Request.TLS.VerifiedChains[0][0])
+			method = DeviceAuthCertificate
+		} else if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+			var keyID int
+			device, keyID, ok = deviceFromAPIKey(apiKey)
+			if ok {
+				c.Set(deviceAPIKeyContextKey, keyID)
+			}
+			method = DeviceAuthAPIKey
+		} else if userName, password, hasBasic := c.Request.BasicAuth(); hasBasic {
+			device, ok = deviceFromCredentials(userName, password)
+			method = DeviceAuthPassword
+		} else if token := bearerToken(c); token != "" {
+			device, ok = deviceFromToken(token)
+			method = DeviceAuthToken
+		} else {
+			c.Header("WWW-Authenticate", `Basic realm="device"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Device credentials are required"})
+			return
+		}
+
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid device credentials"})
+			return
+		}
+
+		c.Set(deviceContextKey, device)
+		c.Set(deviceAuthMethodContextKey, method)
+		c.Next()
+	}
+}
+
+// CurrentDevice returns the device authenticated by DeviceAuth.
+func CurrentDevice(c *gin.Context) (models.Device, bool) {
+	v, exists := c.Get(deviceContextKey)
+	if !exists {
+		return models.Device{}, false
+	}
+	device, ok := v.(models.Device)
+	return device, ok
+}
+
+// CurrentDeviceAPIKeyID returns the ID of the API key the device authenticated
+// with, or nil if it used another method.
+func CurrentDeviceAPIKeyID(c *gin.Context) *int {
+	if v, exists := c.Get(deviceAPIKeyContextKey); exists {
+		if id, ok := v.(int); ok {
+			return &id
+		}
+	}
+	return nil
+}
+
+// CurrentDeviceAuthMethod returns how the device was authenticated.
+func CurrentDeviceAuthMethod(c *gin.Context) string {
+	return c.GetString(deviceAuthMethodContextKey)
+}
+
+// credentialCacheTTL is how long a verified Basic credential skips the
+// password hash check.
+const credentialCacheTTL = time.Minute
+
+type cachedCredential struct {
+	deviceID     int
+	passwordHash string
+	expires      time.Time
+}
+
+// credentialCache remembers recently verified Basic credentials, keyed by a
+// hash of the user name and password, so devices uploading often do not pay
+// for an Argon2 verification on every request.
+var credentialCache = struct {
+	sync.Mutex
+	entries map[[sha256.Size]byte]cachedCredential
+}{entries: make(map[[sha256.Size]byte]cachedCredential)}
+
+func credentialKey(userName, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(userName + "\x00" + password))
+}
+
+func cacheCredential(key [sha256.Size]byte, device models.Device) {
+	now := time.Now()
+	credentialCache.Lock()
+	defer credentialCache.Unlock()
+	for k, entry := range credentialCache.entries {
+		if now.After(entry.expires) {
+			delete(credentialCache.entries, k)
+		}
+	}
+	credentialCache.entries[key] = cachedCredential{deviceID: device.ID, passwordHash: device.Password, expires: now.Add(credentialCacheTTL)}
+}
+
+func deviceFromCredentials(userName, password string) (models.Device, bool) {
+	key := credentialKey(userName, password)
+	credentialCache.Lock()
+	cached, hit := credentialCache.entries[key]
+	credentialCache.Unlock()
+
+	var device models.Device
+	if err := db.DB.Preload("User").Where("user_name = ?", userName).First(&device).Error; err != nil {
+		return models.Device{}, false
+	}
+
+	// A cached credential only counts while the stored hash is unchanged, so
+	// a password change takes effect at once
+	if hit && time.Now().Before(cached.expires) && cached.deviceID == device.ID && cached.passwordHash == device.Password {
+		return device, true
+	}
+
+	ok, needsRehash := auth.VerifyPassword(device.Password, password)
+	if !ok {
+		return models.Device{}, false
+	}
+
+	// Transparently upgrade legacy plaintext or outdated hashes
+	if needsRehash {
+		if hash, err := auth.HashPassword(password); err == nil {
+			if err := db.DB.Model(&models.Device{}).Where("id = ?", device.ID).Update("password", hash).Error; err != nil {
+				log.Printf("failed to rehash password for device %d: %v", device.ID, err)
+			} else {
+				device.Password = hash
+			}
+		}
+	}
+
+	cacheCredential(key, device)
+	return device, true
+}
+
+func deviceFromToken(token string) (models.Device, bool) {
+	var deviceToken models.DeviceToken
+	err := db.DB.
+		Where("token_hash = ? AND revoked_at IS NULL AND expires_at > ?", auth.HashToken(token), time.Now()).
+		First(&deviceToken).Error
+	if err != nil {
+		return models.Device{}, false
+	}
+
+	var device models.Device
+	if err := db.DB.Preload("User").First(&device, deviceToken.DeviceID).Error; err != nil {
+		return models.Device{}, false
+	}
+	return device, true
+}
+
+func deviceFromAPIKey(key string) (models.Device, int, bool) {
+	now := time.Now()
+
+	var apiKey models.DeviceAPIKey
+	err := db.DB.
+		Where("key_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", auth.HashToken(key), now).
+		First(&apiKey).Error
+	if err != nil {
+		return models.Device{}, 0, false
+	}
+
+	var device models.Device
+	if err := db.DB.Preload("User").First(&device, apiKey.DeviceID).Error; err != nil {
+		return models.Device{}, 0, false
+	}
+
+	if err := db.DB.Model(&apiKey).Update("last_used_at", now).Error; err != nil {
+		log.Printf("failed to record API key %d use: %v", apiKey.ID, err)
+	}
+
+	return device, apiKey.ID, true
+}
+
+// deviceFromCertificate maps a verified client certificate to a device by its
+// fingerprint or, failing that, by its subject.
+func deviceFromCertificate(cert *x509.Certificate) (models.Device, bool) {
+	var registered models.DeviceCertificate
+	err := db.DB.
+		Where("revoked_at IS NULL AND (fingerprint = ? OR (fingerprint IS NULL AND subject = ?))",
+			auth.CertificateFingerprint(cert), cert.Subject.String()).
+		Order("fingerprint IS NULL").
+		First(&registered).Error
+	if err != nil {
+		return models.Device{}, false
+	}
+
+	var device models.Device
+	if err := db.DB.Preload("User").First(&device, registered.DeviceID).Error; err != nil {
+		return models.Device{}, false
+	}
+	return device, true
+}
+
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimitKey derives the bucket key for a request.
+type RateLimitKey func(c *gin.Context) string
+
+// ByDevice keys on the authenticated device, falling back to the client IP.
+// It must run after DeviceAuth.
+func ByDevice(c *gin.Context) string {
+	if device, ok := CurrentDevice(c); ok {
+		return "device:" + strconv.Itoa(device.ID)
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// ByUserOrIP keys on the authenticated user, falling back to the client IP.
+func ByUserOrIP(c *gin.Context) string {
+	if claims, ok := CurrentUser(c); ok {
+		return "user:" + strconv.Itoa(claims.UserID)
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// ByIP keys on the client IP.
+func ByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// RateLimit applies a token bucket limit for the named route group. Rejected
+// requests get 429 with Retry-After. If the store fails the request is let
+// through.
+func RateLimit(name string, limit ratelimit.Limit, key RateLimitKey) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed, retryAfter, err := ratelimit.Allow(c.Request.Context(), name+":"+key(c), limit)
+		if err != nil {
+			log.Printf("rate limit %s: %v", name, err)
+			c.Next()
+			return
+		}
+
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+			return
+		}
+
+		c.Next()
+	}
+}
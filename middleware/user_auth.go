@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/auth"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/db"
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const userClaimsContextKey = "user_claims"
+
+// UserAuth requires a valid portal access token in the Authorization header.
+func UserAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="portal"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Access token is required"})
+			return
+		}
+
+		claims, err := auth.ParseAccessToken(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired access token"})
+			return
+		}
+
+		c.Set(userClaimsContextKey, claims)
+		c.Next()
+	}
+}
+
+// CurrentUser returns the claims of the user authenticated by UserAuth.
+func CurrentUser(c *gin.Context) (*auth.Claims, bool) {
+	v, exists := c.Get(userClaimsContextKey)
+	if !exists {
+		return nil, false
+	}
+	claims, ok := v.(*auth.Claims)
+	return claims, ok
+}
+
+// RequirePermission rejects the request unless the authenticated user's role
+// grants perm. It must run after UserAuth.
+func RequirePermission(perm auth.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := CurrentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+			return
+		}
+
+		if !auth.HasPermission(claims.Role, perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Permission denied", "permission": perm})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequireDeviceOwner rejects requests for the device named by the param route
+// parameter unless the user owns it or manages all devices, as snapshots are scoped.
+// Other users' devices look the same as missing ones. It must run after
+// UserAuth.
+func RequireDeviceOwner(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := CurrentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "User is not authenticated"})
+			return
+		}
+		if auth.ManagesAllDevices(claims.Role) {
+			c.Next()
+			return
+		}
+
+		deviceID, err := strconv.Atoi(c.Param(param))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+			return
+		}
+
+		var device models.Device
+		err = db.DB.Select("id").Where("id = ? AND device_user_id = ?", deviceID, claims.UserID).First(&device).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database error: " + err.Error()})
+			return
+		}
+
+		c.Next()
+	}
+}
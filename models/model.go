@@ -7,17 +7,26 @@ import (
 	"gorm.io/datatypes"
 )
 
+// Snapshot is one uploaded frame. CapturedAt is the device's capture time,
+// or ReceivedAt if the device sent none. ClientID is the device's own id for
+// the frame, which makes retried uploads idempotent.
 type Snapshot struct {
-	ID               int             `gorm:"primaryKey;autoIncrement"`
-	Name             string          `json:"name"`
-	DeviceID         int             `json:"device_id"`
-	RpiNo            string          `json:"rpi_no"`
-	DistanceCM       decimal.Decimal `gorm:"column:distance_cm;type:numeric"`
-	ImagePath        string          `json:"image_path"`
-	AuthenticatedURL string          `json:"authenticated_url"`
-	CapturedAt       time.Time       `gorm:"autoCreateTime"`
-	Detection        datatypes.JSON  `gorm:"type:jsonb"`
-	FileAvailable    bool            `json:"file_available"`
+	ID                  int                 `gorm:"primaryKey;autoIncrement"`
+	Name                string              `json:"name"`
+	DeviceID            int                 `gorm:"uniqueIndex:idx_snapshot_device_client,priority:1" json:"device_id"`
+	RpiNo               string              `json:"rpi_no"`
+	DistanceCM          decimal.NullDecimal `gorm:"column:distance_cm;type:numeric;index"`
+	ImagePath           string              `json:"image_path"`
+	AuthenticatedURL    string              `json:"authenticated_url"`
+	CapturedAt          time.Time           `gorm:"not null;index"`
+	Detection           datatypes.JSON      `gorm:"type:jsonb"`
+	FileAvailable       bool                `json:"file_available"`
+	APIKeyID            *int                `json:"api_key_id"`
+	ThumbnailsAvailable bool                `json:"thumbnails_available"`
+	ReceivedAt          time.Time           `gorm:"autoCreateTime" json:"received_at"`
+	ClockSkewSeconds    *float64            `json:"clock_skew_seconds"`
+	ClockSkewed         bool                `gorm:"not null;default:false" json:"clock_skewed"`
+	ClientID            *string             `gorm:"uniqueIndex:idx_snapshot_device_client,priority:2" json:"client_id"`
 }
 
 type Device struct {
@@ -26,18 +35,18 @@ type Device struct {
 	Description  string    `gorm:"not null"`
 	LastModified time.Time `gorm:"autoUpdateTime"`
 	UserName     string    `gorm:"not null"`
-	Password     string    `gorm:"not null"`
+	Password     string    `gorm:"not null" json:"-"`
 	DeviceUserID *int      `gorm:"column:device_user_id"`
 	User         *User     `gorm:"foreignKey:DeviceUserID;references:ID"`
 	Bucket       *string   `json:"bucket"`
 }
 
 type User struct {
-	ID           int    `gorm:"primaryKey;autoIncrement"`
-	Name         string `gorm:"not null"`
-	Email        string `gorm:"unique;not null"`
-	Password     *string
-	Role         string `gorm:"not null"`
+	ID           int     `gorm:"primaryKey;autoIncrement"`
+	Name         string  `gorm:"not null"`
+	Email        string  `gorm:"unique;not null"`
+	Password     *string `json:"-"`
+	Role         string  `gorm:"not null"`
 	LastLogin    *time.Time
 	LastLogout   *time.Time
 	LastLoginIP  *string
@@ -47,10 +56,224 @@ type User struct {
 }
 
 type Classes struct {
-	ID          int    `gorm:"primaryKey;autoIncrement"`
-	Name        string `gorm:"unique;not null"`
-	Description *string
-	CreatedAt   time.Time `gorm:"autoCreateTime"`
+	ID int `gorm:"primaryKey;autoIncrement" json:"id"`
+	// Names differing only in case are the same class
+	Name        string       `gorm:"unique;not null;uniqueIndex:idx_classes_lower_name,expression:lower(name)" json:"name"`
+	Description *string      `json:"description"`
+	ParentID    *int         `gorm:"index" json:"parent_id"`
+	Parent      *Classes     `gorm:"foreignKey:ParentID;constraint:OnDelete:SET NULL" json:"-"`
+	Aliases     []ClassAlias `gorm:"foreignKey:ClassID" json:"aliases,omitempty"`
+	CreatedAt   time.Time    `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// ClassAlias maps another spelling of a class name to its canonical class.
+// Alias is stored lower-cased and matched case-insensitively at ingest.
+type ClassAlias struct {
+	ID        int       `gorm:"primaryKey;autoIncrement" json:"id"`
+	Alias     string    `gorm:"not null;uniqueIndex" json:"alias"`
+	ClassID   int       `gorm:"not null;index" json:"class_id"`
+	Class     Classes   `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// DetectionObject is one detected object of a snapshot, normalised out of
+// Snapshot.Detection so it can be filtered and aggregated in SQL.
+type DetectionObject struct {
+	ID                  int64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	SnapshotID          int      `gorm:"not null;index" json:"snapshot_id"`
+	Snapshot            Snapshot `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	ClassID             int      `gorm:"not null;index" json:"class_id"`
+	Class               Classes  `gorm:"foreignKey:ClassID" json:"-"`
+	BoxX                float64  `gorm:"not null" json:"box_x"`
+	BoxY                float64  `gorm:"not null" json:"box_y"`
+	BoxW                float64  `gorm:"not null" json:"box_w"`
+	BoxH                float64  `gorm:"not null" json:"box_h"`
+	DistanceTopLeft     float64  `gorm:"not null" json:"distance_top_left"`
+	DistanceTopRight    float64  `gorm:"not null" json:"distance_top_right"`
+	DistanceBottomLeft  float64  `gorm:"not null" json:"distance_bottom_left"`
+	DistanceBottomRight float64  `gorm:"not null" json:"distance_bottom_right"`
+	MinDistance         float64  `gorm:"not null;index" json:"min_distance"`
+	Confidence          *float64 `json:"confidence"`
+}
+
+// AlertRule fires when a snapshot of DeviceID has at least MinCount objects
+// of Class (or its aliases and child classes) within MaxDistanceCM, at most
+// once per CooldownSeconds.
+type AlertRule struct {
+	ID              int        `gorm:"primaryKey;autoIncrement" json:"id"`
+	DeviceID        int        `gorm:"not null;index" json:"device_id"`
+	Class           string     `gorm:"not null" json:"class"`
+	MaxDistanceCM   float64    `gorm:"column:max_distance_cm;not null" json:"max_distance_cm"`
+	MinCount        int        `gorm:"not null" json:"min_count"`
+	CooldownSeconds int        `gorm:"not null" json:"cooldown_seconds"`
+	Enabled         bool       `gorm:"not null" json:"enabled"`
+	LastFiredAt     *time.Time `json:"last_fired_at"`
+	CreatedAt       time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt       time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// AlertWebhook is an HTTP endpoint that receives a device's alerts. Secret
+// signs every delivery.
+type AlertWebhook struct {
+	ID        int       `gorm:"primaryKey;autoIncrement" json:"id"`
+	DeviceID  int       `gorm:"not null;index" json:"device_id"`
+	URL       string    `gorm:"not null" json:"url"`
+	Secret    string    `gorm:"not null" json:"-"`
+	Enabled   bool      `gorm:"not null" json:"enabled"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// AlertEvaluation is a stored snapshot whose device's alert rules are still
+// to be evaluated. It is written with the snapshot, so an evaluation cut
+// short by a restart runs again once NextAttemptAt passes.
+type AlertEvaluation struct {
+	ID            int64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	SnapshotID    int       `gorm:"not null;uniqueIndex" json:"snapshot_id"`
+	Snapshot      Snapshot  `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	NextAttemptAt time.Time `gorm:"not null;index" json:"next_attempt_at"`
+	CreatedAt     time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// AlertDelivery is one alert sent to one webhook, with the outcome of its
+// latest attempt. Attempts counts the attempts since the alert was last
+// queued, and a pending delivery is next attempted at NextAttemptAt.
+type AlertDelivery struct {
+	ID             int64          `gorm:"primaryKey;autoIncrement" json:"id"`
+	DeviceID       int            `gorm:"not null;index" json:"device_id"`
+	RuleID         int            `gorm:"not null;index" json:"rule_id"`
+	WebhookID      int            `gorm:"not null;index" json:"webhook_id"`
+	SnapshotID     int            `gorm:"not null;index" json:"snapshot_id"`
+	Payload        datatypes.JSON `gorm:"type:jsonb" json:"payload"`
+	Status         string         `gorm:"not null;index" json:"status"`
+	Attempts       int            `gorm:"not null" json:"attempts"`
+	NextAttemptAt  *time.Time     `gorm:"index" json:"next_attempt_at"`
+	ResponseStatus *int           `json:"response_status"`
+	Error          *string        `json:"error"`
+	CreatedAt      time.Time      `gorm:"autoCreateTime;index" json:"created_at"`
+	DeliveredAt    *time.Time     `json:"delivered_at"`
+}
+
+// ExportJob is an export too large to stream, written in the background to
+// Bucket. Filters is the query string the export was requested with.
+type ExportJob struct {
+	ID         int        `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID     int        `gorm:"not null;index" json:"user_id"`
+	Dataset    string     `gorm:"not null" json:"dataset"`
+	Format     string     `gorm:"not null" json:"format"`
+	Filters    string     `json:"filters"`
+	Status     string     `gorm:"not null;index" json:"status"`
+	Bucket     string     `gorm:"not null" json:"bucket"`
+	ObjectURI  *string    `json:"object_uri"`
+	Rows       int        `gorm:"not null;default:0" json:"rows"`
+	Error      *string    `json:"error"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	// HeartbeatAt is refreshed while an instance holds the job, so jobs
+	// of an instance that stopped can be told apart and failed.
+	HeartbeatAt *time.Time `json:"-"`
+}
+
+type PasswordResetToken struct {
+	ID        int       `gorm:"primaryKey;autoIncrement"`
+	UserID    int       `gorm:"not null;index"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+type DeviceToken struct {
+	ID        int       `gorm:"primaryKey;autoIncrement"`
+	DeviceID  int       `gorm:"not null;index"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	RevokedAt *time.Time
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+type DeviceAPIKey struct {
+	ID         int        `gorm:"primaryKey;autoIncrement" json:"id"`
+	DeviceID   int        `gorm:"not null;index" json:"device_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `gorm:"not null" json:"prefix"`
+	KeyHash    string     `gorm:"uniqueIndex;not null" json:"-"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+type DeviceCertificate struct {
+	ID          int        `gorm:"primaryKey;autoIncrement" json:"id"`
+	DeviceID    int        `gorm:"not null;index" json:"device_id"`
+	Fingerprint *string    `gorm:"uniqueIndex" json:"fingerprint"`
+	Subject     *string    `gorm:"index" json:"subject"`
+	NotAfter    *time.Time `json:"not_after"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	CreatedAt   time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+type DeviceSigningKey struct {
+	ID        int       `gorm:"primaryKey;autoIncrement" json:"id"`
+	DeviceID  int       `gorm:"uniqueIndex;not null" json:"device_id"`
+	PublicKey string    `gorm:"not null" json:"public_key"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// DeviceTimezone is the IANA time zone a device is installed in, used to
+// bucket its analytics by local time. Devices without one use UTC.
+type DeviceTimezone struct {
+	ID        int       `gorm:"primaryKey;autoIncrement" json:"id"`
+	DeviceID  int       `gorm:"uniqueIndex;not null" json:"device_id"`
+	Timezone  string    `gorm:"not null" json:"timezone"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// DeviceSyncStatus is what a device last reported about its offline backlog
+// in the sync handshake.
+type DeviceSyncStatus struct {
+	ID              int        `gorm:"primaryKey;autoIncrement" json:"id"`
+	DeviceID        int        `gorm:"uniqueIndex;not null" json:"device_id"`
+	Status          string     `gorm:"not null" json:"status"`
+	BacklogCount    int        `gorm:"not null" json:"backlog_count"`
+	MissingCount    int        `gorm:"not null" json:"missing_count"`
+	OldestQueuedAt  *time.Time `json:"oldest_queued_at"`
+	NewestQueuedAt  *time.Time `json:"newest_queued_at"`
+	LastHandshakeAt time.Time  `gorm:"not null" json:"last_handshake_at"`
+}
+
+type DeviceNonce struct {
+	ID        int       `gorm:"primaryKey;autoIncrement"`
+	DeviceID  int       `gorm:"not null;uniqueIndex:idx_device_nonce"`
+	Nonce     string    `gorm:"not null;uniqueIndex:idx_device_nonce"`
+	CreatedAt time.Time `gorm:"autoCreateTime;index"`
+}
+
+type RefreshToken struct {
+	ID        int       `gorm:"primaryKey;autoIncrement"`
+	UserID    int       `gorm:"not null;index"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	RevokedAt *time.Time
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+type AuditEvent struct {
+	ID         int            `gorm:"primaryKey;autoIncrement" json:"id"`
+	ActorType  string         `gorm:"not null;index:idx_audit_actor" json:"actor_type"`
+	ActorID    *int           `gorm:"index:idx_audit_actor" json:"actor_id"`
+	IP         string         `json:"ip"`
+	Action     string         `gorm:"not null;index" json:"action"`
+	Targets    datatypes.JSON `gorm:"type:jsonb" json:"targets"`
+	Result     string         `gorm:"not null;index" json:"result"`
+	StatusCode int            `json:"status_code"`
+	CreatedAt  time.Time      `gorm:"autoCreateTime;index" json:"created_at"`
+}
+
+type RateLimitBucket struct {
+	Key       string    `gorm:"primaryKey"`
+	Tokens    float64   `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"not null"`
 }
 
 type ServiceAccount struct {
@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mahamudul-Dev/aisense_portal_snapshot/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PostgresStore keeps buckets in the rate_limit_buckets table so limits are
+// shared by every instance.
+type PostgresStore struct {
+	db *gorm.DB
+
+	mu    sync.Mutex
+	takes int
+}
+
+func NewPostgresStore(db *gorm.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	s.takes++
+	prune := s.takes%sweepEvery == 0
+	s.mu.Unlock()
+	if prune {
+		s.prune(ctx, key, limit, now)
+	}
+
+	var allowed bool
+	var retryAfter time.Duration
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Make sure the row exists, then lock it for the read-modify-write.
+		// The no-op update locks an existing row at once, so pruning cannot
+		// delete it in between.
+		fresh := models.RateLimitBucket{Key: key, Tokens: float64(limit.Burst), UpdatedAt: now}
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key"}},
+			DoUpdates: clause.Assignments(map[string]any{"key": gorm.Expr("EXCLUDED.key")}),
+		}).Create(&fresh).Error
+		if err != nil {
+			return err
+		}
+
+		var bucket models.RateLimitBucket
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&bucket).Error; err != nil {
+			return err
+		}
+
+		elapsed := now.Sub(bucket.UpdatedAt)
+		if elapsed < 0 {
+			// Another instance's clock is ahead; don't refill
+			elapsed = 0
+		}
+
+		var tokens float64
+		tokens, allowed, retryAfter = refill(bucket.Tokens, elapsed, limit)
+		return tx.Model(&bucket).Where("key = ?", key).
+			Updates(map[string]any{"tokens": tokens, "updated_at": now}).Error
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to take rate limit token: %w", err)
+	}
+
+	return allowed, retryAfter, nil
+}
+
+// prune drops the buckets that have refilled completely, since a new bucket
+// would start in the same state. Keys are "<group>:<client>" and only the
+// buckets of key's group share its limit, so only those are considered.
+// Failures are ignored; the next prune catches up.
+func (s *PostgresStore) prune(ctx context.Context, key string, limit Limit, now time.Time) {
+	group, _, _ := strings.Cut(key, ":")
+	group += ":"
+	s.db.WithContext(ctx).
+		Where("left(key, ?) = ? AND updated_at < ?", len(group), group, now.Add(-limit.refillTime())).
+		Delete(&models.RateLimitBucket{})
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket: Rate tokens are added per second up to Burst.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Store keeps token bucket state.
+type Store interface {
+	// Take removes one token from the bucket for key. When the bucket is
+	// empty it returns false and how long until a token is available.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (allowed bool, retryAfter time.Duration, err error)
+}
+
+var store Store = NewMemoryStore()
+
+// SetStore replaces the store used by Allow, e.g. with a PostgresStore so
+// limits hold across instances.
+func SetStore(s Store) {
+	store = s
+}
+
+// Allow takes a token for key from the configured store.
+func Allow(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	return store.Take(ctx, key, limit, time.Now())
+}
+
+// ParseLimit parses limits of the form "<count>/<s|m|h>" with an optional
+// ":<burst>" suffix, e.g. "60/m" or "600/h:20". Burst defaults to count.
+func ParseLimit(spec string) (Limit, error) {
+	spec = strings.TrimSpace(spec)
+	rateSpec, burstSpec, hasBurst := strings.Cut(spec, ":")
+
+	countSpec, unit, ok := strings.Cut(rateSpec, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: expected <count>/<s|m|h>", spec)
+	}
+	count, err := strconv.Atoi(countSpec)
+	if err != nil || count < 1 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: count must be a positive integer", spec)
+	}
+
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return Limit{}, fmt.Errorf("invalid rate limit %q: unit must be s, m or h", spec)
+	}
+
+	burst := count
+	if hasBurst {
+		burst, err = strconv.Atoi(burstSpec)
+		if err != nil || burst < 1 {
+			return Limit{}, fmt.Errorf("invalid rate limit %q: burst must be a positive integer", spec)
+		}
+	}
+
+	return Limit{Rate: float64(count) / per.Seconds(), Burst: burst}, nil
+}
+
+// refillTime is how long an empty bucket takes to fill up. A bucket idle
+// that long is in the same state as a new one.
+func (l Limit) refillTime() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+// refill returns the tokens in a bucket after elapsed time, then takes one if
+// possible.
+func refill(tokens float64, elapsed time.Duration, limit Limit) (remaining float64, allowed bool, retryAfter time.Duration) {
+	tokens = math.Min(float64(limit.Burst), tokens+elapsed.Seconds()*limit.Rate)
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	wait := time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	return tokens, false, wait
+}
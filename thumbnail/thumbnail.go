@@ -0,0 +1,66 @@
+package thumbnail
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+)
+
+// Widths are the thumbnail widths generated for every snapshot.
+var Widths = []int{160, 480}
+
+// MaxPixels bounds the size of images Generate decodes, since a decoded
+// image takes about four bytes per pixel.
+const MaxPixels = 24_000_000
+
+// ObjectName returns where the thumbnail of the given width for an image
+// object is stored, in the same bucket as the image.
+func ObjectName(objectName string, width int) string {
+	return fmt.Sprintf("thumbnails/%d/%s.jpg", width, objectName)
+}
+
+// Generate decodes a JPEG or PNG image and returns a JPEG thumbnail for each
+// of Widths, keyed by width. Images narrower than a width are not upscaled.
+// Images over MaxPixels are rejected before they are decoded.
+func Generate(data []byte) (map[int][]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image header: %w", err)
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, fmt.Errorf("image is %dx%d, more than %d pixels", config.Width, config.Height, MaxPixels)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	bounds := src.Bounds()
+	thumbnails := make(map[int][]byte, len(Widths))
+	for _, width := range Widths {
+		w, h := bounds.Dx(), bounds.Dy()
+		if w > width {
+			h = h * width / w
+			w = width
+		}
+		if h < 1 {
+			h = 1
+		}
+
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+			return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+		}
+		thumbnails[width] = buf.Bytes()
+	}
+
+	return thumbnails, nil
+}